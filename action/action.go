@@ -44,6 +44,10 @@ func compileAction(action string) (string, []string, error) {
 	return cmd, params, nil
 }
 
+// SplitFields splits a string into whitespace separated fields the same way as action params,
+// quotes and backslash escapes are supported
+func SplitFields(field string) []string { return splitFields(field) }
+
 func splitFields(field string) []string {
 	if len(field) == 0 {
 		return nil
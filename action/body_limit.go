@@ -0,0 +1,91 @@
+package action
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitedBody fails reading when more than limit bytes are read from underlying body
+type limitedBody struct {
+	io.ReadCloser
+	limit    int64
+	remain   int64
+	exceeded bool
+}
+
+func (self *limitedBody) Read(buf []byte) (int, error) {
+	if self.exceeded {
+		return 0, errBodyTooLarge
+	}
+
+	if int64(len(buf)) > self.remain+1 {
+		buf = buf[:self.remain+1]
+	}
+
+	n, err := self.ReadCloser.Read(buf)
+	if int64(n) <= self.remain {
+		self.remain -= int64(n)
+		return n, err
+	}
+
+	n = int(self.remain)
+	self.remain = 0
+	self.exceeded = true
+	return n, errBodyTooLarge
+}
+
+// LimitBody rejects requests whose body is larger than limit bytes with 413. Requests with
+// Content-Length are rejected at once, others are rejected when the body is read past the limit.
+func LimitBody(limit int64, underlying http.Handler) http.Handler {
+	return http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		if req.ContentLength > limit {
+			INFO_LOG("request body of %s %s is %d bytes, exceeds limit %d, rejected", req.Method, req.URL.String(), req.ContentLength, limit)
+			http.Error(rsp, "Request Entity Too Large", 413)
+			return
+		}
+
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = &limitedBody{ReadCloser: req.Body, limit: limit, remain: limit}
+		}
+		underlying.ServeHTTP(rsp, req)
+	})
+}
+
+// bodyTooLarge tells whether reading body of req failed because of LimitBody
+func bodyTooLarge(req *http.Request) bool {
+	if body, ok := req.Body.(*limitedBody); ok && body.exceeded {
+		INFO_LOG("request body of %s %s exceeds limit %d, rejected", req.Method, req.URL.String(), body.limit)
+		return true
+	}
+	return false
+}
+
+// ParseSize parses sizes like 512, 64k, 10m, 1g
+func ParseSize(size string) (int64, error) {
+	size = strings.ToLower(strings.TrimSpace(size))
+	unit := int64(1)
+	if len(size) > 0 {
+		switch size[len(size)-1] {
+		case 'k':
+			unit = 1 << 10
+		case 'm':
+			unit = 1 << 20
+		case 'g':
+			unit = 1 << 30
+		}
+		if unit > 1 {
+			size = size[:len(size)-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("Invalid size " + size)
+	}
+	return n * unit, nil
+}
@@ -0,0 +1,103 @@
+package action
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zerozwt/Vert/env"
+)
+
+func TestLimitBody(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		rsp.Write(body)
+	}))
+	defer upstream.Close()
+
+	handler, err := ActionHandler("proxy "+upstream.URL+"/", http.NotFoundHandler())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	front := httptest.NewServer(LimitBody(8, handler))
+	defer front.Close()
+
+	check := func(body io.Reader, content_length int64, code int) {
+		req, _ := http.NewRequest("POST", front.URL+"/", body)
+		req.ContentLength = content_length
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != code {
+			t.Errorf("status code not as expected: expected=%d actual=%d content_length=%d", code, rsp.StatusCode, content_length)
+		}
+	}
+
+	check(strings.NewReader("12345678"), 8, 200)
+	check(strings.NewReader("123456789"), 9, 413)
+
+	//chunked requests are checked while being forwarded
+	check(ioutil.NopCloser(strings.NewReader("12345678")), -1, 200)
+	check(ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 1<<20))), -1, 413)
+}
+
+type brokenReader struct{}
+
+func (self brokenReader) Read(buf []byte) (int, error) { return 0, errors.New("client gone") }
+
+func TestLimitBodyPassive(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		rsp.Write(body)
+	}))
+	defer upstream.Close()
+
+	err := env.AddUpsteam(map[string][]string{
+		"limit_test max_fails=1 fail_timeout=1m": {strings.TrimPrefix(upstream.URL, "http://")},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	handler, err := ActionHandler("proxy http://{up:limit_test}/", http.NotFoundHandler())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	handler = LimitBody(8, handler)
+
+	serve := func(body io.Reader) int {
+		req := httptest.NewRequest("POST", "http://example.com/", body)
+		req.ContentLength = -1
+		rsp := httptest.NewRecorder()
+		handler.ServeHTTP(rsp, env.WrapRequest(req))
+		return rsp.Code
+	}
+
+	//oversized and broken request bodies are faults of clients, not of the upstream entry
+	for i := 0; i < 2; i++ {
+		if code := serve(ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 1<<20)))); code != 413 {
+			t.Errorf("oversized body should get 413: %d", code)
+		}
+		if code := serve(io.MultiReader(strings.NewReader("1234"), brokenReader{})); code != 400 {
+			t.Errorf("broken body should get 400: %d", code)
+		}
+	}
+
+	for _, group := range env.UpstreamStatus() {
+		if group.Name == "limit_test" && (len(group.Entries) != 1 || !group.Entries[0].Available) {
+			t.Errorf("upstream entry should stay available: %v", group.Entries)
+		}
+	}
+	if code := serve(strings.NewReader("1234")); code != 200 {
+		t.Errorf("request after client failures should succeed: %d", code)
+	}
+}
@@ -0,0 +1,287 @@
+package action
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// content types treated as text by content modifiers
+var gTextTypes []string = []string{
+	"text/*",
+	"application/atom+xml",
+	"application/ecmascript",
+	"application/json",
+	"application/javascript",
+	"application/rss+xml",
+	"application/soap+xml",
+	"application/xhtml+xml",
+	"application/xml",
+}
+
+var defaultCompressCodings []string = []string{"br", "zstd", "gzip"}
+var defaultCompressTypes []string = append(append([]string{}, gTextTypes...), "image/svg+xml")
+
+const defaultCompressMinLength int64 = 1024
+
+// levels used if not configured, and the valid range of each coding
+var gCompressLevels map[string][3]int = map[string][3]int{
+	"br":      {5, 0, 11},
+	"zstd":    {3, 1, 22},
+	"gzip":    {6, 1, 9},
+	"deflate": {6, 1, 9},
+}
+
+// Compression holds settings of response compression shared by wwwroot and proxy
+type Compression struct {
+	codings    []string // in order of preference
+	levels     map[string]int
+	min_length int64 // responses shorter than this are sent as is
+	types      []string
+
+	pools map[string]*sync.Pool
+}
+
+var gCompression atomic.Value // *Compression
+
+// ParseCompression builds compression settings, empty values stand for defaults
+func ParseCompression(codings []string, levels map[string]int, min_length string, types []string) (*Compression, error) {
+	ret := &Compression{
+		codings:    defaultCompressCodings,
+		levels:     make(map[string]int),
+		min_length: defaultCompressMinLength,
+		types:      defaultCompressTypes,
+		pools:      make(map[string]*sync.Pool),
+	}
+
+	if len(codings) > 0 {
+		ret.codings = make([]string, 0, len(codings))
+		for _, coding := range codings {
+			coding = strings.ToLower(coding)
+			if _, ok := gCompressLevels[coding]; !ok {
+				return nil, errors.New("Invalid compression coding " + coding)
+			}
+			ret.codings = append(ret.codings, coding)
+		}
+	}
+
+	for coding, level := range gCompressLevels {
+		ret.levels[coding] = level[0]
+	}
+	for coding, level := range levels {
+		limit, ok := gCompressLevels[coding]
+		if !ok {
+			return nil, errors.New("Invalid compression coding " + coding)
+		}
+		if level < limit[1] || level > limit[2] {
+			return nil, errors.New("Invalid compression level of " + coding + ": " + strconv.Itoa(level))
+		}
+		ret.levels[coding] = level
+	}
+
+	if len(min_length) > 0 {
+		var err error
+		if ret.min_length, err = ParseSize(min_length); err != nil {
+			return nil, errors.New("Invalid compression min_length " + min_length)
+		}
+	}
+
+	if len(types) > 0 {
+		ret.types = make([]string, 0, len(types))
+		for _, item := range types {
+			item = strings.ToLower(strings.TrimSpace(item))
+			if strings.Count(item, "/") != 1 {
+				return nil, errors.New("Invalid compression type " + item)
+			}
+			ret.types = append(ret.types, item)
+		}
+	}
+
+	for coding := range gCompressLevels {
+		ret.pools[coding] = &sync.Pool{}
+	}
+	return ret, nil
+}
+
+func SetCompression(conf *Compression) {
+	if conf == nil {
+		conf, _ = ParseCompression(nil, nil, "", nil)
+	}
+	gCompression.Store(conf)
+}
+
+func curCompression() *Compression {
+	if ret, ok := gCompression.Load().(*Compression); ok {
+		return ret
+	}
+	SetCompression(nil)
+	return gCompression.Load().(*Compression)
+}
+
+// matchContentType tells whether the media type of content_type matches one of types,
+// which are either exact media types or "type/*"
+func matchContentType(content_type string, types []string) bool {
+	media := strings.ToLower(strings.TrimSpace(strings.Split(content_type, ";")[0]))
+	if len(media) == 0 {
+		return false
+	}
+	for _, item := range types {
+		if item == media || (strings.HasSuffix(item, "/*") && strings.HasPrefix(media, item[:len(item)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+func isTextContentType(content_type string) bool {
+	return matchContentType(content_type, gTextTypes)
+}
+
+// compressible tells whether a response of status and header should be compressed
+func (self *Compression) compressible(status int, header http.Header) bool {
+	if status < 200 || status == 204 || status == 206 || status == 304 {
+		return false
+	}
+	if len(header.Values("Content-Encoding")) > 0 || len(header.Get("Content-Range")) > 0 {
+		return false
+	}
+	if strings.Contains(strings.ToLower(header.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+
+	content_type := header.Get("Content-Type")
+	//event streams are flushed message by message, compressing them delays messages
+	if !matchContentType(content_type, self.types) || matchContentType(content_type, []string{"text/event-stream"}) {
+		return false
+	}
+
+	if length := header.Get("Content-Length"); len(length) > 0 {
+		if n, err := strconv.ParseInt(length, 10, 64); err == nil && n < self.min_length {
+			return false
+		}
+	}
+	return true
+}
+
+type pooledEncoder struct {
+	encodeWriter
+	pool *sync.Pool
+}
+
+func (self *pooledEncoder) Close() error {
+	err := self.encodeWriter.Close()
+	self.pool.Put(self.encodeWriter)
+	return err
+}
+
+// newEncoder encodes data written to out with coding, which should be one of gCompressLevels.
+// Encoders are reused once closed.
+func (self *Compression) newEncoder(coding string, out io.Writer) encodeWriter {
+	pool, ok := self.pools[coding]
+	if !ok {
+		coding, pool = "gzip", self.pools["gzip"]
+	}
+
+	type resetter interface {
+		encodeWriter
+		Reset(io.Writer)
+	}
+	writer, ok := pool.Get().(resetter)
+	if ok {
+		writer.Reset(out)
+		return &pooledEncoder{writer, pool}
+	}
+
+	level := self.levels[coding]
+	switch coding {
+	case "br":
+		writer = brotli.NewWriterLevel(out, level)
+	case "zstd":
+		writer, _ = zstd.NewWriter(out, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+			zstd.WithEncoderConcurrency(1))
+	case "deflate":
+		writer, _ = zlib.NewWriterLevel(out, level)
+	default:
+		writer, _ = gzip.NewWriterLevel(out, level)
+	}
+	return &pooledEncoder{writer, pool}
+}
+
+// compressRspWriter compresses the response with the best coding the client accepts,
+// if the response is compressible. Close must be called after the response is written.
+type compressRspWriter struct {
+	underlying http.ResponseWriter
+	req        *http.Request
+	conf       *Compression
+
+	writer      encodeWriter // nil if the response is not compressed
+	wroteHeader bool
+}
+
+func newCompressRspWriter(rsp http.ResponseWriter, req *http.Request) *compressRspWriter {
+	return &compressRspWriter{underlying: rsp, req: req, conf: curCompression()}
+}
+
+func (self *compressRspWriter) Header() http.Header {
+	return self.underlying.Header()
+}
+
+func (self *compressRspWriter) WriteHeader(status int) {
+	if self.wroteHeader {
+		return
+	}
+	self.wroteHeader = true
+
+	header := self.underlying.Header()
+	if self.conf.compressible(status, header) {
+		addVary(header, "Accept-Encoding")
+		if coding := negotiateEncoding(self.req, self.conf.codings); len(coding) > 0 {
+			header.Set("Content-Encoding", coding)
+			header.Del("Content-Length")
+			if etag := header.Get("ETag"); strings.HasPrefix(etag, "\"") {
+				//compressed content is not byte-for-byte identical to the original one
+				header.Set("ETag", "W/"+etag)
+			}
+			if self.req.Method != "HEAD" {
+				self.writer = self.conf.newEncoder(coding, self.underlying)
+			}
+		}
+	}
+	self.underlying.WriteHeader(status)
+}
+
+func (self *compressRspWriter) Write(buf []byte) (int, error) {
+	self.WriteHeader(200)
+	if self.writer == nil {
+		return self.underlying.Write(buf)
+	}
+	return self.writer.Write(buf)
+}
+
+// Flush sends out compressed data of everything written
+func (self *compressRspWriter) Flush() {
+	if self.writer != nil {
+		self.writer.Flush()
+	}
+	if flusher, ok := self.underlying.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (self *compressRspWriter) Close() error {
+	if self.writer == nil {
+		return nil
+	}
+	err := self.writer.Close()
+	self.writer = nil
+	return err
+}
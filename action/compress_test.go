@@ -0,0 +1,256 @@
+package action
+
+import (
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/zerozwt/Vert/env"
+)
+
+func TestParseCompression(t *testing.T) {
+	bad := []struct {
+		codings    []string
+		levels     map[string]int
+		min_length string
+		types      []string
+	}{
+		{[]string{"lzma"}, nil, "", nil},
+		{nil, map[string]int{"gzip": 10}, "", nil},
+		{nil, map[string]int{"zstd": 0}, "", nil},
+		{nil, nil, "1x", nil},
+		{nil, nil, "", []string{"text"}},
+	}
+	for _, item := range bad {
+		if _, err := ParseCompression(item.codings, item.levels, item.min_length, item.types); err == nil {
+			t.Errorf("compression settings should be rejected: %v", item)
+		}
+	}
+
+	conf, err := ParseCompression([]string{"gzip", "br"}, map[string]int{"br": 11}, "2k", []string{"text/*", "application/json"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if conf.levels["br"] != 11 || conf.levels["gzip"] != 6 || conf.min_length != 2048 {
+		t.Errorf("compression settings not as expected: %v %d", conf.levels, conf.min_length)
+	}
+	if !matchContentType("text/css; charset=utf-8", conf.types) || matchContentType("image/svg+xml", conf.types) {
+		t.Errorf("content types not matched as expected")
+	}
+}
+
+func TestCompressWWWRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vert_compress")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	content := strings.Repeat("hello vert ", 1000)
+	ioutil.WriteFile(filepath.Join(dir, "page.html"), []byte(content), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "small.txt"), []byte("hello"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "data.bin"), []byte(content), 0644)
+
+	handler, err := ActionHandler("wwwroot "+dir, http.NotFoundHandler())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cases := []struct {
+		path   string
+		accept string
+		rng    string
+		expect string
+		status int
+	}{
+		{"/page.html", "gzip, deflate", "", "gzip", 200},
+		{"/page.html", "gzip;q=0.8, zstd", "", "zstd", 200},
+		{"/page.html", "gzip, br, zstd", "", "br", 200},
+		{"/page.html", "", "", "", 200},
+		{"/page.html", "gzip", "bytes=0-9", "", 206},
+		{"/small.txt", "gzip", "", "", 200},
+		{"/data.bin", "gzip", "", "", 200},
+	}
+	for _, item := range cases {
+		req := httptest.NewRequest("GET", "http://example.com"+item.path, nil)
+		if len(item.accept) > 0 {
+			req.Header.Set("Accept-Encoding", item.accept)
+		}
+		if len(item.rng) > 0 {
+			req.Header.Set("Range", item.rng)
+		}
+		rsp := httptest.NewRecorder()
+		handler.ServeHTTP(rsp, req)
+
+		coding := rsp.Header().Get("Content-Encoding")
+		if rsp.Code != item.status || coding != item.expect {
+			t.Errorf("%s with %q not as expected: status=%d coding=%s", item.path, item.accept, rsp.Code, coding)
+			continue
+		}
+		if len(coding) == 0 {
+			continue
+		}
+		if length := rsp.Header().Get("Content-Length"); len(length) > 0 {
+			t.Errorf("compressed %s should have no Content-Length: %s", item.path, length)
+		}
+		body, err := newDecoder(coding, rsp.Body)
+		if err != nil {
+			t.Errorf("decode %s with %q failed: %v", item.path, item.accept, err)
+			continue
+		}
+		data, err := ioutil.ReadAll(body)
+		if err != nil || string(data) != content {
+			t.Errorf("content of %s with %q not as expected: length=%d %v", item.path, item.accept, len(data), err)
+		}
+	}
+}
+
+func TestPrecompressedWWWRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vert_precompressed")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	content := strings.Repeat("console.log('hello vert');\n", 100)
+	files := map[string]string{
+		"app.js":            content,
+		"app.js.br":         "precompressed br content",
+		"app.js.gz":         "precompressed gzip content",
+		"sub/index.html":    content,
+		"sub/index.html.gz": "precompressed index",
+	}
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	for name, data := range files {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+	}
+
+	handler, err := ActionHandler("wwwroot "+dir, http.NotFoundHandler())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	serve := func(path string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		for idx := 0; idx+1 < len(headers); idx += 2 {
+			req.Header.Set(headers[idx], headers[idx+1])
+		}
+		rsp := httptest.NewRecorder()
+		handler.ServeHTTP(rsp, req)
+		return rsp
+	}
+
+	cases := []struct {
+		path   string
+		accept string
+		expect string
+		file   string
+	}{
+		{"/app.js", "gzip, br", "br", "app.js.br"},
+		{"/app.js", "gzip, br;q=0.5", "gzip", "app.js.gz"},
+		{"/app.js", "", "", "app.js"},
+		{"/sub/", "br, gzip", "gzip", "sub/index.html.gz"},
+	}
+	for _, item := range cases {
+		rsp := serve(item.path, "Accept-Encoding", item.accept)
+		header := rsp.Header()
+		if rsp.Code != 200 || header.Get("Content-Encoding") != item.expect || rsp.Body.String() != files[item.file] {
+			t.Errorf("%s with %q not as expected: status=%d coding=%s body=%q", item.path, item.accept,
+				rsp.Code, header.Get("Content-Encoding"), rsp.Body.String())
+			continue
+		}
+		if header.Get("Content-Length") != strconv.Itoa(len(files[item.file])) {
+			t.Errorf("Content-Length of %s with %q not as expected: %s", item.path, item.accept, header.Get("Content-Length"))
+		}
+		content_type := mime.TypeByExtension(filepath.Ext(item.path))
+		if len(content_type) > 0 && header.Get("Content-Type") != content_type {
+			t.Errorf("Content-Type of %s with %q not as expected: %s", item.path, item.accept, header.Get("Content-Type"))
+		}
+		if len(item.expect) > 0 && (len(header.Get("ETag")) == 0 || header.Get("Vary") != "Accept-Encoding") {
+			t.Errorf("headers of %s with %q not as expected: %v", item.path, item.accept, header)
+		}
+	}
+
+	//no precompressed file in the coding, compressed on the fly
+	rsp := serve("/app.js", "Accept-Encoding", "zstd")
+	if body, err := newDecoder(rsp.Header().Get("Content-Encoding"), rsp.Body); err != nil {
+		t.Errorf("decode dynamically compressed content failed: %v", err)
+	} else if data, _ := ioutil.ReadAll(body); rsp.Header().Get("Content-Encoding") != "zstd" || string(data) != content {
+		t.Errorf("dynamically compressed content not as expected: %v", rsp.Header())
+	}
+
+	rsp = serve("/app.js", "Accept-Encoding", "br", "Range", "bytes=0-9")
+	if rsp.Code != 206 || rsp.Body.String() != files["app.js.br"][:10] ||
+		rsp.Header().Get("Content-Length") != "10" || rsp.Header().Get("Content-Encoding") != "br" {
+		t.Errorf("range of precompressed file not as expected: status=%d %v", rsp.Code, rsp.Header())
+	}
+
+	etag := serve("/app.js", "Accept-Encoding", "br").Header().Get("ETag")
+	if rsp = serve("/app.js", "Accept-Encoding", "br", "If-None-Match", etag); rsp.Code != 304 {
+		t.Errorf("precompressed file with matched ETag should get 304: %d", rsp.Code)
+	}
+	if other := serve("/app.js", "Accept-Encoding", "gzip").Header().Get("ETag"); other == etag {
+		t.Errorf("precompressed files of different codings should have different ETags: %s", etag)
+	}
+}
+
+func TestProxyCompress(t *testing.T) {
+	content := strings.Repeat("hello upstream ", 1000)
+	backend := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		rsp.Header().Set("Content-Type", "application/json")
+		rsp.Header().Set("ETag", `"v1"`)
+		if req.URL.Path == "/gzip" {
+			rsp.Header().Set("Content-Encoding", "gzip")
+			zw := curCompression().newEncoder("gzip", rsp)
+			zw.Write([]byte(content))
+			zw.Close()
+			return
+		}
+		rsp.Write([]byte(content))
+	}))
+	defer backend.Close()
+
+	handler, err := ActionHandler("proxy "+backend.URL+"{path} compress=on", http.NotFoundHandler())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, path := range []string{"/plain", "/gzip"} {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rsp := httptest.NewRecorder()
+		handler.ServeHTTP(rsp, env.WrapRequest(req))
+
+		if rsp.Header().Get("Content-Encoding") != "gzip" {
+			t.Errorf("response of %s should be compressed: %v", path, rsp.Header())
+			continue
+		}
+		etag := `W/"v1"`
+		if path == "/gzip" {
+			etag = `"v1"`
+		}
+		if rsp.Header().Get("ETag") != etag {
+			t.Errorf("ETag of %s not as expected: %s", path, rsp.Header().Get("ETag"))
+		}
+		body, err := newDecoder("gzip", rsp.Body)
+		if err != nil {
+			t.Errorf("decode response of %s failed: %v", path, err)
+			continue
+		}
+		data, err := ioutil.ReadAll(body)
+		if err != nil || string(data) != content {
+			t.Errorf("content of %s not as expected: length=%d %v", path, len(data), err)
+		}
+	}
+}
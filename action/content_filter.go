@@ -0,0 +1,109 @@
+package action
+
+import (
+	"io"
+	"regexp"
+	"unicode/utf8"
+)
+
+const defaultFilterBuffer int64 = 1 << 16
+
+// streamFilter replaces matches of a regexp in a stream. Matches are assumed to be no longer
+// than window bytes, so data older than window bytes is written out as soon as it arrives.
+// Another window of written data is kept as look-behind context of \b, ^ and the like.
+type streamFilter struct {
+	pattern  *regexp.Regexp
+	template []byte
+	window   int
+	out      io.Writer
+
+	buf     []byte
+	written int // bytes of buf already written out
+	err     error
+}
+
+func newStreamFilter(pattern *regexp.Regexp, template []byte, window int, out io.Writer) *streamFilter {
+	return &streamFilter{pattern: pattern, template: template, window: window, out: out}
+}
+
+func (self *streamFilter) Write(data []byte) (int, error) {
+	if self.err != nil {
+		return 0, self.err
+	}
+	self.buf = append(self.buf, data...)
+	self.flush(len(self.buf)-self.window, false)
+	return len(data), self.err
+}
+
+// Close writes out all buffered data, the underlying writer is not closed
+func (self *streamFilter) Close() error {
+	if self.err == nil {
+		self.flush(len(self.buf), true)
+	}
+	return self.err
+}
+
+// flush writes out data before limit, replacing matches starting before limit. At the end of
+// stream, an empty match at limit is replaced as well.
+func (self *streamFilter) flush(limit int, final bool) {
+	if limit <= self.written && !final {
+		return
+	}
+
+	out := make([]byte, 0, len(self.buf)-self.written)
+	last := self.written
+	for _, match := range self.matches() {
+		if match[0] > limit || (match[0] == limit && !final) {
+			break
+		}
+		out = append(out, self.buf[last:match[0]]...)
+		out = self.pattern.Expand(out, self.template, self.buf, match)
+		last = match[1]
+	}
+	if last < limit {
+		out = append(out, self.buf[last:limit]...)
+		last = limit
+	}
+	self.written = last
+
+	if _, err := self.out.Write(out); err != nil {
+		self.err = err
+		return
+	}
+
+	//keep a window of written data as context
+	if drop := self.written - self.window; drop > 0 {
+		self.buf = append(self.buf[:0], self.buf[drop:]...)
+		self.written -= drop
+	}
+}
+
+// matches finds matches starting from written. The search starts in the written data for
+// look-behind context, but a match there crossing written hides matches starting from written,
+// so the search is tried again with less context.
+func (self *streamFilter) matches() [][]int {
+	for _, start := range []int{0, self.written - utf8.UTFMax, self.written} {
+		if start < 0 {
+			start = 0
+		}
+
+		crossed := false
+		ret := make([][]int, 0)
+		for _, match := range self.pattern.FindAllSubmatchIndex(self.buf[start:], -1) {
+			if match[0]+start < self.written {
+				crossed = crossed || match[1]+start > self.written
+				continue
+			}
+			for idx := range match {
+				if match[idx] >= 0 {
+					match[idx] += start
+				}
+			}
+			ret = append(ret, match)
+		}
+		if !crossed || start == self.written {
+			return ret
+		}
+	}
+	return nil
+}
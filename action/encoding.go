@@ -0,0 +1,148 @@
+package action
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// content codings Vert can decode, in order of preference
+var gContentCodings []string = []string{"br", "zstd", "gzip", "deflate"}
+
+// encodeWriter is a compressing writer, Flush sends out compressed data of everything written
+type encodeWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// parseAcceptEncoding returns q-values of codings in an Accept-Encoding header, see RFC 7231 section 5.3.4
+func parseAcceptEncoding(values []string) map[string]float64 {
+	ret := make(map[string]float64)
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			fields := strings.Split(item, ";")
+			coding := strings.ToLower(strings.TrimSpace(fields[0]))
+			if len(coding) == 0 {
+				continue
+			}
+			q := 1.0
+			for _, param := range fields[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") || strings.HasPrefix(param, "Q=") {
+					if tmp, err := strconv.ParseFloat(param[2:], 64); err == nil && tmp >= 0 && tmp <= 1 {
+						q = tmp
+					}
+				}
+			}
+			if coding == "x-gzip" {
+				coding = "gzip"
+			}
+			ret[coding] = q
+		}
+	}
+	return ret
+}
+
+// acceptedCodings returns codings in candidates accepted by req, ordered by q-value then by candidates
+func acceptedCodings(req *http.Request, candidates []string) []string {
+	accept := parseAcceptEncoding(req.Header.Values("Accept-Encoding"))
+	ret := make([]string, 0, len(candidates))
+	weights := make(map[string]float64)
+	for _, coding := range candidates {
+		q, ok := accept[coding]
+		if !ok {
+			q, ok = accept["*"]
+		}
+		if ok && q > 0 {
+			weights[coding] = q
+			//insertion sort keeps the order of candidates for equal q-values
+			idx := len(ret)
+			for idx > 0 && weights[ret[idx-1]] < q {
+				idx--
+			}
+			ret = append(ret, "")
+			copy(ret[idx+1:], ret[idx:])
+			ret[idx] = coding
+		}
+	}
+	return ret
+}
+
+// negotiateEncoding chooses the best coding in candidates for req, empty for identity
+func negotiateEncoding(req *http.Request, candidates []string) string {
+	if codings := acceptedCodings(req, candidates); len(codings) > 0 {
+		return codings[0]
+	}
+	return ""
+}
+
+// contentCoding returns the single content coding of header in lower case, empty for identity
+func contentCoding(header http.Header) string {
+	coding := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding")))
+	if coding == "identity" {
+		return ""
+	}
+	if coding == "x-gzip" {
+		return "gzip"
+	}
+	return coding
+}
+
+func canDecode(coding string) bool {
+	for _, item := range gContentCodings {
+		if item == coding {
+			return true
+		}
+	}
+	return len(coding) == 0
+}
+
+// newDecoder decodes body of coding, which should be one of gContentCodings or empty.
+// The returned reader should be closed if it is an io.Closer.
+func newDecoder(coding string, body io.Reader) (io.Reader, error) {
+	switch coding {
+	case "gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		//deflate should be zlib format, but some servers send raw deflate data
+		reader := bufio.NewReader(body)
+		head, err := reader.Peek(2)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(head) == 2 && head[0]&0x0F == 8 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 {
+			return zlib.NewReader(reader)
+		}
+		return flate.NewReader(reader), nil
+	case "br":
+		return brotli.NewReader(body), nil
+	case "zstd":
+		decoder, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return body, nil
+}
+
+// addVary adds key to Vary header if it is not there
+func addVary(header http.Header, key string) {
+	for _, value := range header.Values("Vary") {
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item == "*" || strings.EqualFold(item, key) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", key)
+}
@@ -0,0 +1,178 @@
+package action
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// TrustedProxies decides whether forwarding headers sent by a client can be trusted
+type TrustedProxies struct {
+	cidrs []*net.IPNet
+	unix  bool // requests from unix sockets are trusted
+}
+
+var gTrustedProxies atomic.Value // *TrustedProxies
+
+// ParseTrustedProxies parses a list of CIDRs or single IPs, "unix:" stands for unix socket clients
+func ParseTrustedProxies(list []string) (*TrustedProxies, error) {
+	ret := &TrustedProxies{}
+	for _, item := range list {
+		if item == "unix:" {
+			ret.unix = true
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, errors.New("Invalid trusted proxy " + item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			ret.cidrs = append(ret.cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, errors.New("Invalid trusted proxy " + item)
+		}
+		ret.cidrs = append(ret.cidrs, cidr)
+	}
+	return ret, nil
+}
+
+func SetTrustedProxies(proxies *TrustedProxies) {
+	if proxies == nil {
+		proxies = &TrustedProxies{}
+	}
+	gTrustedProxies.Store(proxies)
+}
+
+func curTrustedProxies() *TrustedProxies {
+	if ret, ok := gTrustedProxies.Load().(*TrustedProxies); ok {
+		return ret
+	}
+	return &TrustedProxies{}
+}
+
+// IsTrustedProxy tells whether addr, an IP or empty for unix socket clients, is a trusted proxy
+func IsTrustedProxy(addr string) bool { return curTrustedProxies().trusted(addr) }
+
+// trusted tells whether addr, an IP or empty for unix socket clients, is a trusted proxy
+func (self *TrustedProxies) trusted(addr string) bool {
+	if len(addr) == 0 {
+		return self.unix
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range self.cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns IP of the direct peer, empty for unix socket clients
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// setForwarded sets X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host, X-Real-IP and optionally
+// Forwarded headers of an upstream request. Incoming values are kept and appended to only if the
+// peer is a trusted proxy, otherwise they are replaced.
+func setForwarded(header http.Header, req *http.Request, forwarded bool) {
+	proxies := curTrustedProxies()
+	remote := remoteIP(req)
+	trusted := proxies.trusted(remote)
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	chain := make([]string, 0)
+	if trusted {
+		for _, value := range header.Values("X-Forwarded-For") {
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); len(item) > 0 {
+					chain = append(chain, item)
+				}
+			}
+		}
+	}
+	if len(remote) > 0 {
+		chain = append(chain, remote)
+	}
+
+	//client is the last address not belonging to trusted proxies
+	client := remote
+	for idx := len(chain) - 1; idx >= 0; idx-- {
+		client = chain[idx]
+		if !proxies.trusted(chain[idx]) {
+			break
+		}
+	}
+
+	if !trusted || len(header.Get("X-Forwarded-Proto")) == 0 {
+		header.Set("X-Forwarded-Proto", proto)
+	}
+	if !trusted || len(header.Get("X-Forwarded-Host")) == 0 {
+		header.Set("X-Forwarded-Host", req.Host)
+	}
+	header.Del("X-Forwarded-For")
+	if len(chain) > 0 {
+		header.Set("X-Forwarded-For", strings.Join(chain, ", "))
+	}
+	header.Del("X-Real-IP")
+	if len(client) > 0 {
+		header.Set("X-Real-IP", client)
+	}
+
+	if !forwarded {
+		if !trusted {
+			header.Del("Forwarded")
+		}
+		return
+	}
+	elements := make([]string, 0)
+	if trusted {
+		elements = append(elements, header.Values("Forwarded")...)
+	}
+	node := "unknown"
+	if len(remote) > 0 {
+		node = remote
+		if strings.Contains(remote, ":") {
+			node = "[" + remote + "]"
+		}
+	}
+	elements = append(elements, "for="+forwardedValue(node)+";host="+forwardedValue(req.Host)+";proto="+proto)
+	header.Set("Forwarded", strings.Join(elements, ", "))
+}
+
+// forwardedValue quotes value if it is not a token, see RFC 7239 section 4
+func forwardedValue(value string) string {
+	for _, ch := range value {
+		if !isTokenChar(ch) {
+			return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(value) + "\""
+		}
+	}
+	return value
+}
+
+func isTokenChar(ch rune) bool {
+	if ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", ch)
+}
@@ -2,16 +2,19 @@ package action
 
 import (
 	"bytes"
-	"compress/gzip"
+	"context"
 	"errors"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/zerozwt/Vert/env"
 )
 
 var upgrader = websocket.Upgrader{
@@ -24,7 +27,7 @@ func init() {
 }
 
 func proxy(params []string, underlying http.Handler) (http.Handler, error) {
-	if len(params) != 1 {
+	if len(params) < 1 {
 		return nil, errors.New("proxy params count invalid")
 	}
 
@@ -35,35 +38,173 @@ func proxy(params []string, underlying http.Handler) (http.Handler, error) {
 	scheme := params[0][:scheme_idx]
 
 	if scheme == "http" || scheme == "https" {
-		return proxyNormal(params[0])
+		return proxyNormal(params[0], params[1:])
 	}
 
 	if scheme == "ws" || scheme == "wss" {
-		return proxyWebsocket(params[0])
+		return proxyWebsocket(params[0], params[1:])
 	}
 
 	return nil, errors.New("invalid proxy scheme: " + scheme)
 }
 
-func proxyNormal(param string) (http.Handler, error) {
+const defaultRetryBody int64 = 1 << 16
+
+func proxyNormal(param string, options []string) (http.Handler, error) {
 	v, err := convertActionParam(param)
 	if err != nil {
 		return nil, err
 	}
 
-	return &reverseProxy{
+	ret := &reverseProxy{
 		target_addr:     v,
+		retry_body:      defaultRetryBody,
+		filter_buffer:   defaultFilterBuffer,
 		mod_rsp_header:  make([]rspHeaderModifier, 0),
 		mod_rsp_content: make([]rspContentModifier, 0),
-	}, nil
+	}
+	if err := ret.parseOptions(options); err != nil {
+		return nil, err
+	}
+	if ret.client, ret.proxy_client, err = ret.transport.clients(); err != nil {
+		return nil, err
+	}
+	return ret, nil
 }
 
 type reverseProxy struct {
-	target_addr     Variable
+	target_addr Variable
+
+	retries    int   // max retries of idempotent requests
+	retry_5xx  bool  // retry on 5xx responses besides connection errors
+	retry_body int64 // max request body size buffered for retries
+	forwarded  bool  // send RFC 7239 Forwarded header
+	compress   bool  // compress responses arriving uncompressed
+
+	filter_buffer int64 // max content buffered by content modifiers
+
+	transport    transportConf
+	client       *http.Client
+	proxy_client *http.Client // sends PROXY protocol headers
+
 	mod_rsp_header  []rspHeaderModifier
 	mod_rsp_content []rspContentModifier
 }
 
+// parseOptions parses options following proxy target:
+//
+//	retries=N  retry_on=error,5xx  retry_body=64k  forwarded=on  filter_buffer=64k  compress=on
+//
+// and options of transportConf.
+func (self *reverseProxy) parseOptions(options []string) error {
+	for _, option := range options {
+		idx := strings.Index(option, "=")
+		if idx <= 0 {
+			return errors.New("Malformed proxy option " + option)
+		}
+		key, value := option[:idx], option[idx+1:]
+
+		var err error
+		switch key {
+		case "retries":
+			self.retries, err = strconv.Atoi(value)
+			if err != nil || self.retries < 0 {
+				return errors.New("Invalid retries " + value)
+			}
+		case "retry_on":
+			for _, item := range strings.Split(value, ",") {
+				if item == "5xx" {
+					self.retry_5xx = true
+				} else if item != "error" {
+					return errors.New("Invalid retry_on " + value)
+				}
+			}
+		case "retry_body":
+			if self.retry_body, err = ParseSize(value); err != nil {
+				return err
+			}
+		case "filter_buffer":
+			if self.filter_buffer, err = ParseSize(value); err != nil || self.filter_buffer <= 0 {
+				return errors.New("Invalid filter_buffer " + value)
+			}
+		case "forwarded":
+			if value != "on" && value != "off" {
+				return errors.New("Invalid forwarded " + value)
+			}
+			self.forwarded = value == "on"
+		case "compress":
+			if value != "on" && value != "off" {
+				return errors.New("Invalid compress " + value)
+			}
+			self.compress = value == "on"
+		default:
+			ok, err := self.transport.parseOption(key, value)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return errors.New("unknown proxy option " + key)
+			}
+		}
+	}
+	return nil
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// clientBody records errors reading request body from the client, which are not failures of upstreams
+type clientBody struct {
+	reader io.Reader
+	failed int32
+}
+
+func (self *clientBody) Read(buf []byte) (int, error) {
+	n, err := self.reader.Read(buf)
+	if err != nil && err != io.EOF {
+		atomic.StoreInt32(&(self.failed), 1)
+	}
+	return n, err
+}
+
+func (self *clientBody) Failed() bool { return atomic.LoadInt32(&(self.failed)) != 0 }
+
+// replayBody buffers request body so that it can be sent again by retries. It returns a function
+// creating body of each attempt, and the number of retries allowed for req.
+func (self *reverseProxy) replayBody(req *http.Request, client *clientBody) (func() io.Reader, int, error) {
+	retries := self.retries
+	if !isIdempotent(req.Method) {
+		retries = 0
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return func() io.Reader { return http.NoBody }, retries, nil
+	}
+
+	stream := func() io.Reader { return client }
+	if retries == 0 {
+		return stream, 0, nil
+	}
+	if req.ContentLength > self.retry_body {
+		return stream, 0, nil
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(client, self.retry_body+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if int64(len(data)) > self.retry_body {
+		//too large to buffer, send what has been read followed by the rest
+		body := io.MultiReader(bytes.NewReader(data), client)
+		return func() io.Reader { return body }, 0, nil
+	}
+	return func() io.Reader { return bytes.NewReader(data) }, retries, nil
+}
+
 func (self *reverseProxy) AddRspHeaderModifier(item rspHeaderModifier) {
 	self.mod_rsp_header = append([]rspHeaderModifier{item}, self.mod_rsp_header...)
 }
@@ -73,26 +214,86 @@ func (self *reverseProxy) AddRspContentModifier(item rspContentModifier) {
 }
 
 func (self *reverseProxy) ServeHTTP(rsp http.ResponseWriter, req *http.Request) {
-	upstream_addr := self.target_addr.Parse(req)
-
-	upstream_req, err := http.NewRequest(req.Method, upstream_addr, req.Body)
+	client_body := &clientBody{reader: req.Body}
+	body, retries, err := self.replayBody(req, client_body)
 	if err != nil {
-		ERROR_LOG("create upstream request (%s) failed: %v", upstream_addr, err)
-		http.Error(rsp, err.Error(), 502)
+		if bodyTooLarge(req) {
+			http.Error(rsp, "Request Entity Too Large", 413)
+			return
+		}
+		ERROR_LOG("read request body of %s %s failed: %v", req.Method, req.URL.String(), err)
+		http.Error(rsp, "Bad Request", 400)
 		return
 	}
-	upstream_req.Header = req.Header.Clone()
 
-	//if there is any content modifier, Accept-Encoding should be deleted from request's header
-	if len(self.mod_rsp_content) > 0 {
-		upstream_req.Header.Del("Accept-Encoding")
-	}
+	var upstream_rsp *http.Response
+	var tracker *env.Attempt
+	for attempt := 0; ; attempt++ {
+		env.BeginAttempt(req)
+		upstream_addr := self.target_addr.Parse(req)
+		if env.NoUpstream(req) {
+			ERROR_LOG("no upstream entry available for %s %s", req.Method, req.URL.String())
+			http.Error(rsp, "Service Unavailable", 503)
+			return
+		}
 
-	upstream_rsp, err := http.DefaultClient.Do(upstream_req)
-	if err != nil {
-		ERROR_LOG("upstream request (%s) failed: %v", upstream_addr, err)
-		http.Error(rsp, err.Error(), 502)
-		return
+		upstream_req, err := http.NewRequest(req.Method, upstream_addr, body())
+		if err != nil {
+			ERROR_LOG("create upstream request (%s) failed: %v", upstream_addr, err)
+			http.Error(rsp, "Bad Gateway", 502)
+			return
+		}
+		upstream_req.Header = req.Header.Clone()
+		setForwarded(upstream_req.Header, req, self.forwarded)
+
+		//if there is any content modifier, upstream should only use codings both Vert and the client understand
+		if len(self.mod_rsp_content) > 0 {
+			upstream_req.Header.Del("Accept-Encoding")
+			if codings := acceptedCodings(req, gContentCodings); len(codings) > 0 {
+				upstream_req.Header.Set("Accept-Encoding", strings.Join(codings, ", "))
+			}
+		}
+
+		client := self.client
+		if header := env.ProxyHeader(req); header != nil {
+			client = self.proxy_client
+			upstream_req = upstream_req.WithContext(env.WithProxyHeader(upstream_req.Context(), header))
+		}
+
+		tracker = env.SendAttempt(req)
+		upstream_rsp, err = client.Do(upstream_req)
+		if err != nil && (bodyTooLarge(req) || client_body.Failed()) {
+			//the client is to blame, the upstream entry is not reported as failed
+			tracker.Close()
+			if bodyTooLarge(req) {
+				http.Error(rsp, "Request Entity Too Large", 413)
+				return
+			}
+			ERROR_LOG("read request body of %s %s failed: %v", req.Method, req.URL.String(), err)
+			http.Error(rsp, "Bad Request", 400)
+			return
+		}
+		tracker.Done(env.AttemptFailed(upstream_rsp, err))
+
+		retry := attempt < retries && (err != nil || (self.retry_5xx && upstream_rsp.StatusCode >= 500))
+		if err != nil {
+			tracker.Close()
+			ERROR_LOG("upstream request (%s) failed: %v", upstream_addr, err)
+			if !retry {
+				http.Error(rsp, "Bad Gateway", 502)
+				return
+			}
+		} else if retry {
+			ERROR_LOG("upstream request (%s) failed: status %d", upstream_addr, upstream_rsp.StatusCode)
+			upstream_rsp.Body.Close()
+			tracker.Close()
+		}
+
+		if !retry {
+			defer tracker.Close()
+			break
+		}
+		INFO_LOG("retry %s %s, attempt #%d", req.Method, req.URL.String(), attempt+1)
 	}
 
 	for _, header_modifier := range self.mod_rsp_header {
@@ -104,42 +305,119 @@ func (self *reverseProxy) ServeHTTP(rsp http.ResponseWriter, req *http.Request)
 			rsp.Header().Add(key, value)
 		}
 	}
+	for _, cookie := range tracker.Cookies() {
+		http.SetCookie(rsp, cookie)
+	}
 	defer upstream_rsp.Body.Close()
 
-	if len(self.mod_rsp_content) == 0 {
+	if len(self.mod_rsp_content) == 0 || !isTextContentType(upstream_rsp.Header.Get("Content-Type")) ||
+		!canDecode(contentCoding(upstream_rsp.Header)) {
+		var out http.ResponseWriter = rsp
+		if self.compress {
+			writer := newCompressRspWriter(rsp, req)
+			defer writer.Close()
+			out = writer
+		}
 		buf := make([]byte, 4096)
-		rsp.WriteHeader(upstream_rsp.StatusCode)
-		io.CopyBuffer(rsp, upstream_rsp.Body, buf)
-	} else {
-		content, err := ioutil.ReadAll(upstream_rsp.Body)
-		if err != nil {
-			panic(err)
+		out.WriteHeader(upstream_rsp.StatusCode)
+		io.CopyBuffer(out, upstream_rsp.Body, buf)
+		return
+	}
+	self.filterBody(rsp, req, upstream_rsp)
+}
+
+// filterBody streams upstream body through content modifiers. Compressed body is decoded before
+// filtering, and filtered content is compressed as configured by SetCompression. The length of
+// filtered content is unknown, so it is sent chunked.
+func (self *reverseProxy) filterBody(rsp http.ResponseWriter, req *http.Request, upstream_rsp *http.Response) {
+	//read the first chunk before sending header, so that an upstream failing at once gets 502
+	buf := make([]byte, 4096)
+	body, err := newDecoder(contentCoding(upstream_rsp.Header), upstream_rsp.Body)
+	n := 0
+	if err == nil {
+		if closer, ok := body.(io.Closer); ok {
+			defer closer.Close()
 		}
-		if isTextContentType(upstream_rsp.Header.Get("Content-Type")) {
-			for _, content_modifier := range self.mod_rsp_content {
-				content = content_modifier.ModifyContent(req, content)
-			}
-			if acceptGZip(req) {
-				rsp.Header().Set("Content-Encoding", "gzip")
-				buf := bytes.NewBuffer(nil)
-				zw := gzip.NewWriter(buf)
-				zw.Write(content)
-				zw.Close()
-				content = buf.Bytes()
+		n, err = body.Read(buf)
+	}
+	if err != nil && err != io.EOF {
+		ERROR_LOG("read upstream response of %s %s failed: %v", req.Method, req.URL.String(), err)
+		for key := range rsp.Header() {
+			rsp.Header().Del(key)
+		}
+		http.Error(rsp, "Bad Gateway", 502)
+		return
+	}
+
+	rsp.Header().Del("Content-Length")
+	rsp.Header().Del("Content-Encoding")
+	addVary(rsp.Header(), "Accept-Encoding")
+	if etag := rsp.Header().Get("ETag"); strings.HasPrefix(etag, "\"") {
+		//content is changed, it is no longer byte-for-byte identical to the upstream one
+		rsp.Header().Set("ETag", "W/"+etag)
+	}
+
+	writer := newCompressRspWriter(rsp, req)
+	var sink io.Writer = writer
+
+	filters := make([]io.WriteCloser, len(self.mod_rsp_content))
+	for idx := len(self.mod_rsp_content) - 1; idx >= 0; idx-- {
+		filters[idx] = self.mod_rsp_content[idx].Filter(req, sink, int(self.filter_buffer))
+		sink = filters[idx]
+	}
+
+	writer.WriteHeader(upstream_rsp.StatusCode)
+	for {
+		if n > 0 {
+			if _, write_err := sink.Write(buf[:n]); write_err != nil {
+				ERROR_LOG("write filtered response of %s %s failed: %v", req.Method, req.URL.String(), write_err)
+				return
 			}
+			writer.Flush()
 		}
-		rsp.Header().Set("Content-Length", fmt.Sprint(len(content)))
-		rsp.WriteHeader(upstream_rsp.StatusCode)
-		rsp.Write(content)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			//header is sent, abort the response so that the client does not take it as complete
+			ERROR_LOG("read upstream response of %s %s failed: %v", req.Method, req.URL.String(), err)
+			panic(http.ErrAbortHandler)
+		}
+		n, err = body.Read(buf)
+	}
+
+	for _, filter := range filters {
+		filter.Close()
 	}
+	writer.Close()
 }
 
-func proxyWebsocket(param string) (http.Handler, error) {
+func proxyWebsocket(param string, options []string) (http.Handler, error) {
 	v, err := convertActionParam(param)
 	if err != nil {
 		return nil, err
 	}
 
+	//only transport options are available for websocket
+	transport := transportConf{}
+	for _, option := range options {
+		idx := strings.Index(option, "=")
+		if idx <= 0 {
+			return nil, errors.New("Malformed proxy option " + option)
+		}
+		ok, err := transport.parseOption(option[:idx], option[idx+1:])
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errors.New("websocket proxy does not support option " + option[:idx])
+		}
+	}
+	dailer, err := transport.wsDialer()
+	if err != nil {
+		return nil, err
+	}
+
 	ws_headers := []string{
 		"Upgrade",
 		"Connection",
@@ -156,15 +434,30 @@ func proxyWebsocket(param string) (http.Handler, error) {
 	}
 
 	return http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		env.BeginAttempt(req)
 		upstream_addr := v.Parse(req)
-		dailer := &websocket.Dialer{}
+		if env.NoUpstream(req) {
+			ERROR_LOG("no upstream entry available for websocket %s", req.URL.String())
+			http.Error(rsp, "Service Unavailable", 503)
+			return
+		}
+		ctx := req.Context()
+		if header := env.ProxyHeader(req); header != nil {
+			ctx = env.WithProxyHeader(ctx, header)
+		}
 
 		req_header := req.Header.Clone()
 		for _, item := range ws_headers {
 			req_header.Del(item)
 		}
+		setForwarded(req_header, req, false)
+
+		//the tunnel counts as an in flight request until it is closed
+		tracker := env.SendAttempt(req)
+		defer tracker.Close()
 
-		up_conn, up_rsp, err := dailer.Dial(upstream_addr, req_header)
+		up_conn, up_rsp, err := dailer.DialContext(ctx, upstream_addr, req_header)
+		tracker.Done(err != nil)
 		if err != nil {
 			ERROR_LOG("create upstream websocket (%s) failed: %v", upstream_addr, err)
 			http.Error(rsp, err.Error(), 502)
@@ -176,6 +469,9 @@ func proxyWebsocket(param string) (http.Handler, error) {
 		for _, item := range ws_rsp_headers {
 			up_rsp_header.Del(item)
 		}
+		for _, cookie := range tracker.Cookies() {
+			up_rsp_header.Add("Set-Cookie", cookie.String())
+		}
 
 		conn, err := upgrader.Upgrade(rsp, req, up_rsp_header)
 		if err != nil {
@@ -185,6 +481,9 @@ func proxyWebsocket(param string) (http.Handler, error) {
 		}
 		defer conn.Close()
 
+		tunnel := gWsTunnels.Add(conn, up_conn)
+		defer gWsTunnels.Remove(tunnel)
+
 		ch := make(chan bool, 2)
 
 		copy := func(from, to *websocket.Conn) {
@@ -192,7 +491,7 @@ func proxyWebsocket(param string) (http.Handler, error) {
 			for {
 				mt, msg, err := from.ReadMessage()
 				if err != nil {
-					if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
 						ERROR_LOG("websocket read failed: %v", err)
 					}
 					to.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Time{})
@@ -215,28 +514,86 @@ func proxyWebsocket(param string) (http.Handler, error) {
 	}), nil
 }
 
-var ctAppText map[string]bool = map[string]bool{
-	"application/atom+xml":   true,
-	"application/ecmascript": true,
-	"application/json":       true,
-	"application/javascript": true,
-	"application/rss+xml":    true,
-	"application/soap+xml":   true,
-	"application/xhtml+xml":  true,
-	"application/xml":        true,
+type wsTunnel struct {
+	client   *websocket.Conn
+	upstream *websocket.Conn
+}
+
+// wsTunnelSet tracks proxied websockets, which are hijacked and thus invisible to http.Server.Shutdown
+type wsTunnelSet struct {
+	lock    sync.Mutex
+	tunnels map[*wsTunnel]bool
+	done    chan bool // closed when the set becomes empty while shutting down
+}
+
+var gWsTunnels *wsTunnelSet = &wsTunnelSet{
+	tunnels: make(map[*wsTunnel]bool),
 }
 
-func isTextContentType(content_type string) bool {
-	if len(content_type) == 0 {
-		return false
+func (self *wsTunnelSet) Add(client, upstream *websocket.Conn) *wsTunnel {
+	ret := &wsTunnel{client: client, upstream: upstream}
+
+	self.lock.Lock()
+	self.tunnels[ret] = true
+	shutting_down := self.done != nil
+	self.lock.Unlock()
+
+	if shutting_down {
+		// shutdown in progress, ask the new tunnel to leave as well
+		ret.goingAway()
 	}
-	if strings.HasPrefix(content_type, "text/") {
-		return true
+	return ret
+}
+
+func (self *wsTunnelSet) Remove(tunnel *wsTunnel) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	delete(self.tunnels, tunnel)
+	if self.done != nil && len(self.tunnels) == 0 {
+		close(self.done)
+		self.done = nil
 	}
-	_, ok := ctAppText[strings.Split(content_type, ";")[0]]
-	return ok
 }
 
-func acceptGZip(req *http.Request) bool {
-	return strings.Index(req.Header.Get("Accept-Encoding"), "gzip") >= 0
+func (self *wsTunnel) goingAway() {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	deadline := time.Now().Add(time.Second)
+	self.client.WriteControl(websocket.CloseMessage, msg, deadline)
+	self.upstream.WriteControl(websocket.CloseMessage, msg, deadline)
+}
+
+// ShutdownWebsocket sends close frames to both ends of every proxied websocket, and waits
+// until all of them are closed. Tunnels still alive when ctx is done are closed forcibly.
+func ShutdownWebsocket(ctx context.Context) error {
+	gWsTunnels.lock.Lock()
+	if len(gWsTunnels.tunnels) == 0 {
+		gWsTunnels.lock.Unlock()
+		return nil
+	}
+	done := make(chan bool)
+	gWsTunnels.done = done
+	tunnels := make([]*wsTunnel, 0, len(gWsTunnels.tunnels))
+	for tunnel := range gWsTunnels.tunnels {
+		tunnels = append(tunnels, tunnel)
+	}
+	gWsTunnels.lock.Unlock()
+
+	for _, tunnel := range tunnels {
+		tunnel.goingAway()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	gWsTunnels.lock.Lock()
+	defer gWsTunnels.lock.Unlock()
+	for tunnel := range gWsTunnels.tunnels {
+		tunnel.client.Close()
+		tunnel.upstream.Close()
+	}
+	return ctx.Err()
 }
@@ -0,0 +1,437 @@
+package action
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zerozwt/Vert/env"
+)
+
+type testLogger struct{}
+
+func (self testLogger) DEBUG_LOG(format string, args []interface{}) {}
+func (self testLogger) INFO_LOG(format string, args []interface{})  {}
+func (self testLogger) ERROR_LOG(format string, args []interface{}) { fmt.Printf(format+"\n", args...) }
+
+func init() {
+	SetLogger(testLogger{})
+}
+
+func newEchoWebsocketServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(rsp, req, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(mt, msg)
+		}
+	}))
+}
+
+func TestShutdownWebsocket(t *testing.T) {
+	upstream := newEchoWebsocketServer()
+	defer upstream.Close()
+
+	handler, err := ActionHandler("proxy ws://"+strings.TrimPrefix(upstream.URL, "http://")+"/", http.NotFoundHandler())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	front := httptest.NewServer(handler)
+	defer front.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+strings.TrimPrefix(front.URL, "http://")+"/", nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Errorf("echo through proxy failed: msg=%s err=%v", msg, err)
+		return
+	}
+
+	ch_close := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadMessage()
+		ch_close <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := ShutdownWebsocket(ctx); err != nil {
+		t.Errorf("shutdown websocket failed: %v", err)
+		return
+	}
+
+	if err := <-ch_close; !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("client did not receive going away close frame: %v", err)
+	}
+}
+
+func TestProxyRetry(t *testing.T) {
+	hits := int32(0)
+	alive := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		body, _ := ioutil.ReadAll(req.Body)
+		rsp.Write(body)
+	}))
+	defer alive.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead_addr := strings.TrimPrefix(dead.URL, "http://")
+	dead.Close()
+
+	err := env.AddUpsteam(map[string][]string{
+		"retry_test round_robin max_fails=1 fail_timeout=1m": {dead_addr, strings.TrimPrefix(alive.URL, "http://")},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	handler, err := ActionHandler("proxy http://{up:retry_test}/ retries=1", http.NotFoundHandler())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	front := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(rsp, env.WrapRequest(req))
+	}))
+	defer front.Close()
+
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest("PUT", front.URL+"/", strings.NewReader("payload"))
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if rsp.StatusCode != 200 || string(body) != "payload" {
+			t.Errorf("retried request not as expected: status=%d body=%s", rsp.StatusCode, body)
+			return
+		}
+	}
+
+	if n := atomic.LoadInt32(&hits); n != 4 {
+		t.Errorf("alive upstream should serve every request: hits=%d", n)
+	}
+
+	if _, err := ActionHandler("proxy http://{up:retry_test}/ retry_on=timeout", http.NotFoundHandler()); err == nil {
+		t.Errorf("invalid retry_on should fail")
+	}
+}
+
+func TestStickySession(t *testing.T) {
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+			rsp.Write([]byte(name))
+		}))
+	}
+	up_a, up_b := newServer("A"), newServer("B")
+	defer up_a.Close()
+	defer up_b.Close()
+
+	err := env.AddUpsteam(map[string][]string{
+		"sticky_test sticky=srv": {strings.TrimPrefix(up_a.URL, "http://"), strings.TrimPrefix(up_b.URL, "http://")},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	handler, err := ActionHandler("proxy http://{up:sticky_test}/", http.NotFoundHandler())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	front := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(rsp, env.WrapRequest(req))
+	}))
+	defer front.Close()
+
+	get := func(cookie string) (string, string) {
+		req, _ := http.NewRequest("GET", front.URL+"/", nil)
+		if len(cookie) > 0 {
+			req.Header.Set("Cookie", "srv="+cookie)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return "", ""
+		}
+		defer rsp.Body.Close()
+		body, _ := ioutil.ReadAll(rsp.Body)
+		for _, item := range rsp.Cookies() {
+			if item.Name == "srv" {
+				return string(body), item.Value
+			}
+		}
+		return string(body), ""
+	}
+
+	backend, cookie := get("")
+	if len(cookie) == 0 {
+		t.Errorf("sticky cookie is not set on first response")
+		return
+	}
+	for i := 0; i < 4; i++ {
+		if tmp, set := get(cookie); tmp != backend || len(set) > 0 {
+			t.Errorf("request with sticky cookie not as expected: backend=%s expected=%s cookie=%s", tmp, backend, set)
+			return
+		}
+	}
+
+	if _, set := get(cookie[:strings.Index(cookie, ".")] + ".forged"); len(set) == 0 {
+		t.Errorf("forged sticky cookie should be replaced")
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	SetTrustedProxies(proxies)
+	defer SetTrustedProxies(nil)
+
+	cases := []struct {
+		remote    string
+		xff       string
+		forwarded string
+		expect    map[string]string
+	}{
+		//untrusted client: incoming values are replaced
+		{"1.2.3.4:5678", "6.6.6.6", "for=6.6.6.6", map[string]string{
+			"X-Forwarded-For":   "1.2.3.4",
+			"X-Real-IP":         "1.2.3.4",
+			"X-Forwarded-Proto": "http",
+			"X-Forwarded-Host":  "example.com",
+			"Forwarded":         "for=1.2.3.4;host=example.com;proto=http",
+		}},
+		//trusted proxies: incoming values are appended to, client is the last untrusted address
+		{"10.1.1.1:5678", "6.6.6.6, 192.168.1.1", "for=6.6.6.6", map[string]string{
+			"X-Forwarded-For":   "6.6.6.6, 192.168.1.1, 10.1.1.1",
+			"X-Real-IP":         "6.6.6.6",
+			"X-Forwarded-Proto": "https",
+			"Forwarded":         "for=6.6.6.6, for=10.1.1.1;host=example.com;proto=http",
+		}},
+		{"[::1]:5678", "", "", map[string]string{
+			"X-Forwarded-For": "::1",
+			"Forwarded":       "for=\"[::1]\";host=example.com;proto=http",
+		}},
+	}
+
+	for _, item := range cases {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = item.remote
+		header := http.Header{}
+		header.Set("X-Forwarded-Proto", "https")
+		if len(item.xff) > 0 {
+			header.Set("X-Forwarded-For", item.xff)
+		}
+		if len(item.forwarded) > 0 {
+			header.Set("Forwarded", item.forwarded)
+		}
+
+		setForwarded(header, req, true)
+		for key, value := range item.expect {
+			if header.Get(key) != value {
+				t.Errorf("%s from %s not as expected: expected=%s actual=%s", key, item.remote, value, header.Get(key))
+			}
+		}
+	}
+}
+
+func TestProxyTransport(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/redirect" {
+			http.Redirect(rsp, req, "/target", http.StatusFound)
+			return
+		}
+		rsp.Write([]byte(req.URL.Path))
+	}))
+	defer backend.Close()
+
+	ca_file, err := ioutil.TempFile("", "vert-ca-")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.Remove(ca_file.Name())
+	pem.Encode(ca_file, &pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+	ca_file.Close()
+
+	call := func(action string, path string) (int, string) {
+		handler, err := ActionHandler(action, http.NotFoundHandler())
+		if err != nil {
+			t.Errorf("build %s failed: %v", action, err)
+			return 0, ""
+		}
+		rsp := httptest.NewRecorder()
+		handler.ServeHTTP(rsp, env.WrapRequest(httptest.NewRequest("GET", "http://example.com"+path, nil)))
+		return rsp.Code, rsp.Body.String()
+	}
+
+	//upstream certificate is verified by ca_file, server_name changes the name verified
+	if code, _ := call("proxy "+backend.URL+"{path}", "/hello"); code != 502 {
+		t.Errorf("unknown CA should fail: %d", code)
+	}
+	if code, body := call("proxy "+backend.URL+"{path} ca_file="+ca_file.Name(), "/hello"); code != 200 || body != "/hello" {
+		t.Errorf("proxy with ca_file not as expected: %d %s", code, body)
+	}
+	if code, _ := call("proxy "+backend.URL+"{path} ca_file="+ca_file.Name()+" server_name=unknown.com", "/hello"); code != 502 {
+		t.Errorf("mismatched server_name should fail: %d", code)
+	}
+	if code, _ := call("proxy "+backend.URL+"{path} insecure_skip_verify=on", "/hello"); code != 200 {
+		t.Errorf("insecure_skip_verify should pass: %d", code)
+	}
+
+	//redirects are passed to the client
+	if code, _ := call("proxy "+backend.URL+"{path} insecure_skip_verify=on", "/redirect"); code != http.StatusFound {
+		t.Errorf("redirect should not be followed: %d", code)
+	}
+
+	invalid := []string{
+		"proxy http://127.0.0.1/ connect_timeout=0s",
+		"proxy http://127.0.0.1/ client_cert=" + ca_file.Name(),
+		"proxy http://127.0.0.1/ ca_file=/nonexistent",
+		"proxy ws://127.0.0.1/ retries=1",
+	}
+	for _, action := range invalid {
+		if _, err := ActionHandler(action, http.NotFoundHandler()); err == nil {
+			t.Errorf("invalid proxy options should fail: %s", action)
+		}
+	}
+}
+
+func TestProxyFilterContent(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/broken" {
+			//promise a body but close the connection at once
+			conn, buf, _ := rsp.(http.Hijacker).Hijack()
+			buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Length: 100\r\n\r\n")
+			buf.Flush()
+			conn.Close()
+			return
+		}
+		rsp.Header().Set("Content-Type", "text/html")
+		rsp.Write([]byte(strings.Repeat("hello upstream ", 1000)))
+	}))
+	defer backend.Close()
+
+	handler, err := ActionHandler("proxy "+backend.URL+"{path}", http.NotFoundHandler())
+	if err == nil {
+		handler, err = ActionHandler("filter-content upstream vert", handler)
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	rsp := httptest.NewRecorder()
+	handler.ServeHTTP(rsp, env.WrapRequest(httptest.NewRequest("GET", "http://example.com/ok", nil)))
+	if rsp.Code != 200 || rsp.Body.String() != strings.Repeat("hello vert ", 1000) {
+		t.Errorf("filtered content not as expected: status=%d length=%d", rsp.Code, rsp.Body.Len())
+	}
+	if length := rsp.Header().Get("Content-Length"); len(length) > 0 {
+		t.Errorf("filtered content should be chunked: Content-Length=%s", length)
+	}
+
+	rsp = httptest.NewRecorder()
+	handler.ServeHTTP(rsp, env.WrapRequest(httptest.NewRequest("GET", "http://example.com/broken", nil)))
+	if rsp.Code != 502 {
+		t.Errorf("broken upstream body should get 502: %d", rsp.Code)
+	}
+}
+
+func TestProxyFilterEncoding(t *testing.T) {
+	content := strings.Repeat("hello upstream ", 1000)
+	backend := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		//answer with the first coding asked by proxy
+		coding := strings.TrimSpace(strings.Split(req.Header.Get("Accept-Encoding"), ",")[0])
+		rsp.Header().Set("Content-Type", "text/plain")
+		rsp.Header().Set("ETag", `"v1"`)
+		if len(coding) == 0 {
+			rsp.Write([]byte(content))
+			return
+		}
+		rsp.Header().Set("Content-Encoding", coding)
+		zw := curCompression().newEncoder(coding, rsp)
+		zw.Write([]byte(content))
+		zw.Close()
+	}))
+	defer backend.Close()
+
+	handler, err := ActionHandler("proxy "+backend.URL+"/", http.NotFoundHandler())
+	if err == nil {
+		handler, err = ActionHandler("filter-content upstream vert", handler)
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cases := []struct {
+		accept string
+		expect string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.5, br", "br"},
+		{"br;q=0.1, deflate;q=0.8", "br"},
+		{"*;q=0.5, br;q=0", "zstd"},
+		{"zstd", "zstd"},
+		{"deflate", ""},
+	}
+	for _, item := range cases {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		if len(item.accept) > 0 {
+			req.Header.Set("Accept-Encoding", item.accept)
+		}
+		rsp := httptest.NewRecorder()
+		handler.ServeHTTP(rsp, env.WrapRequest(req))
+
+		coding := rsp.Header().Get("Content-Encoding")
+		if coding != item.expect {
+			t.Errorf("coding for %q not as expected: %s", item.accept, coding)
+			continue
+		}
+		body, err := newDecoder(coding, rsp.Body)
+		if err != nil {
+			t.Errorf("decode response for %q failed: %v", item.accept, err)
+			continue
+		}
+		data, err := ioutil.ReadAll(body)
+		if err != nil || string(data) != strings.Repeat("hello vert ", 1000) {
+			t.Errorf("filtered content for %q not as expected: length=%d %v", item.accept, len(data), err)
+		}
+		if rsp.Header().Get("Vary") != "Accept-Encoding" || rsp.Header().Get("ETag") != `W/"v1"` {
+			t.Errorf("headers for %q not as expected: %v", item.accept, rsp.Header())
+		}
+	}
+}
@@ -17,7 +17,7 @@ func set_header(params []string, underlying http.Handler) (http.Handler, error)
 		return nil, errors.New("set-header params count invalid")
 	}
 
-	v, err := convertActionParam(params[1])
+	v, err := headerValue(params[1])
 	if err != nil {
 		return nil, err
 	}
@@ -2,6 +2,7 @@ package action
 
 import (
 	"errors"
+	"io"
 	"net/http"
 	"net/textproto"
 	"regexp"
@@ -27,6 +28,10 @@ type rspHeaderMutable interface {
 
 type rspContentModifier interface {
 	ModifyContent(*http.Request, []byte) []byte
+
+	// Filter returns a writer modifying content written to it in a stream, window is the max
+	// size of content buffered
+	Filter(req *http.Request, out io.Writer, window int) io.WriteCloser
 }
 
 type rspContentMutable interface {
@@ -50,7 +55,7 @@ func set_rsp_header(params []string, underlying http.Handler) (http.Handler, err
 		return nil, errors.New("set-rsp-header params count invalid")
 	}
 
-	v, err := convertActionParam(params[1])
+	v, err := headerValue(params[1])
 	if err != nil {
 		return nil, err
 	}
@@ -166,6 +171,10 @@ func (self *filterContent) ModifyContent(req *http.Request, content []byte) []by
 	return self.pattern.ReplaceAll(content, repl)
 }
 
+func (self *filterContent) Filter(req *http.Request, out io.Writer, window int) io.WriteCloser {
+	return newStreamFilter(self.pattern, []byte(self.replacement.Parse(req)), window, out)
+}
+
 func filter_content(params []string, underlying http.Handler) (http.Handler, error) {
 	if len(params) != 2 {
 		return nil, errors.New("filter-content params count invalid")
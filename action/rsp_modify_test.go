@@ -3,7 +3,9 @@ package action
 import (
 	"bytes"
 	"fmt"
+	"math/rand"
 	"net/http"
+	"regexp"
 	"strings"
 	"testing"
 )
@@ -154,3 +156,67 @@ func TestContentModify(t *testing.T) {
 		return
 	}
 }
+
+func TestStreamFilter(t *testing.T) {
+	content := strings.Repeat(`<a href="https://kmr.yjsnpi.com/chapter_4.mp4">Tohno</a> `, 50)
+	cases := []struct {
+		pattern  string
+		template string
+	}{
+		{`://([a-z]+).yjsnpi.com/`, `://www.mur.com/yjsnpi/$1/`},
+		{`\bTohno\b`, `Senpai`},
+		{`^<a`, `<b`},
+		{`x*`, `-`},
+	}
+
+	for _, item := range cases {
+		pattern := regexp.MustCompile(item.pattern)
+		expect := pattern.ReplaceAllString(content, item.template)
+		for _, chunk := range []int{1, 7, 64, len(content)} {
+			out := bytes.NewBuffer(nil)
+			filter := newStreamFilter(pattern, []byte(item.template), 64, out)
+			for idx := 0; idx < len(content); idx += chunk {
+				end := idx + chunk
+				if end > len(content) {
+					end = len(content)
+				}
+				filter.Write([]byte(content[idx:end]))
+			}
+			filter.Close()
+			if out.String() != expect {
+				t.Errorf("stream filter %s with chunk size %d not as expected: %s", item.pattern, chunk, out.String())
+			}
+		}
+	}
+}
+
+func TestStreamFilterRandom(t *testing.T) {
+	patterns := []string{`b[ab]b`, `ab|aba`, `a{1,3}b?`, `\bab`, `b?`, `(a|b)b(a)`}
+	rnd := rand.New(rand.NewSource(1))
+	for _, item := range patterns {
+		pattern := regexp.MustCompile(item)
+		for round := 0; round < 1000; round++ {
+			data := make([]byte, rnd.Intn(60))
+			for idx := range data {
+				data[idx] = "aabb "[rnd.Intn(5)]
+			}
+			window, chunk := 6+rnd.Intn(4), 1+rnd.Intn(5)
+			expect := pattern.ReplaceAll(data, []byte("X$1"))
+
+			out := bytes.NewBuffer(nil)
+			filter := newStreamFilter(pattern, []byte("X$1"), window, out)
+			for idx := 0; idx < len(data); idx += chunk {
+				end := idx + chunk
+				if end > len(data) {
+					end = len(data)
+				}
+				filter.Write(data[idx:end])
+			}
+			filter.Close()
+			if out.String() != string(expect) {
+				t.Errorf("stream filter %s of %q with window %d chunk size %d not as expected: %q, expected %q",
+					item, data, window, chunk, out.String(), expect)
+			}
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package action
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+const secretFilePrefix string = "file:"
+
+// ReadSecret returns content of the file if value is a "file:PATH" reference, otherwise value itself.
+// Trailing line breaks of the file are removed.
+func ReadSecret(value string) (string, error) {
+	if !strings.HasPrefix(value, secretFilePrefix) {
+		return value, nil
+	}
+
+	path := value[len(secretFilePrefix):]
+	if len(path) == 0 {
+		return "", errors.New("empty file path in " + value)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// headerValue builds a header value param, "file:PATH" values are read from file and used as is
+func headerValue(param string) (Variable, error) {
+	if strings.HasPrefix(param, secretFilePrefix) {
+		value, err := ReadSecret(param)
+		if err != nil {
+			return nil, err
+		}
+		return vConst(value), nil
+	}
+	return convertActionParam(param)
+}
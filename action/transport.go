@@ -0,0 +1,158 @@
+package action
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zerozwt/Vert/env"
+)
+
+const defaultConnectTimeout time.Duration = time.Second * 30
+
+// transportConf holds connection options of a proxy action:
+//
+//	connect_timeout=5s  response_header_timeout=30s  max_idle_conns=32
+//	ca_file=/path/ca.pem  client_cert=/path/cert.pem  client_key=/path/key.pem
+//	server_name=backend.internal  insecure_skip_verify=on
+type transportConf struct {
+	connect_timeout         time.Duration
+	response_header_timeout time.Duration
+	max_idle_conns          int // idle connections kept for each upstream address
+
+	ca_file     string
+	client_cert string
+	client_key  string
+	server_name string
+	insecure    bool
+}
+
+// parseOption handles an option of transport, returns false if key is not a transport option
+func (self *transportConf) parseOption(key string, value string) (bool, error) {
+	var err error
+	switch key {
+	case "connect_timeout", "response_header_timeout":
+		timeout, parse_err := time.ParseDuration(value)
+		if parse_err != nil || timeout <= 0 {
+			return true, errors.New("Invalid " + key + " " + value)
+		}
+		if key == "connect_timeout" {
+			self.connect_timeout = timeout
+		} else {
+			self.response_header_timeout = timeout
+		}
+	case "max_idle_conns":
+		self.max_idle_conns, err = strconv.Atoi(value)
+		if err != nil || self.max_idle_conns < 0 {
+			return true, errors.New("Invalid max_idle_conns " + value)
+		}
+	case "ca_file":
+		self.ca_file = value
+	case "client_cert":
+		self.client_cert = value
+	case "client_key":
+		self.client_key = value
+	case "server_name":
+		self.server_name = value
+	case "insecure_skip_verify":
+		if value != "on" && value != "off" {
+			return true, errors.New("Invalid insecure_skip_verify " + value)
+		}
+		self.insecure = value == "on"
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// tlsConfig loads certificates of TLS options, nil if no TLS option is set
+func (self *transportConf) tlsConfig() (*tls.Config, error) {
+	if len(self.ca_file) == 0 && len(self.client_cert) == 0 && len(self.client_key) == 0 &&
+		len(self.server_name) == 0 && !self.insecure {
+		return nil, nil
+	}
+
+	ret := &tls.Config{ServerName: self.server_name, InsecureSkipVerify: self.insecure}
+
+	if len(self.ca_file) > 0 {
+		data, err := ioutil.ReadFile(self.ca_file)
+		if err != nil {
+			return nil, err
+		}
+		ret.RootCAs = x509.NewCertPool()
+		if !ret.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificate found in ca_file " + self.ca_file)
+		}
+	}
+
+	if len(self.client_cert) > 0 || len(self.client_key) > 0 {
+		if len(self.client_cert) == 0 || len(self.client_key) == 0 {
+			return nil, errors.New("client_cert and client_key should be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(self.client_cert, self.client_key)
+		if err != nil {
+			return nil, err
+		}
+		ret.Certificates = []tls.Certificate{cert}
+	}
+	return ret, nil
+}
+
+func (self *transportConf) dial() func(context.Context, string, string) (net.Conn, error) {
+	timeout := self.connect_timeout
+	if timeout == 0 {
+		timeout = defaultConnectTimeout
+	}
+	return env.ProxyProtocolDialer(&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second})
+}
+
+// clients builds the client used normally, and the one sending PROXY protocol headers which
+// never reuses connections. Redirects of upstreams are passed to the client as is.
+func (self *transportConf) clients() (*http.Client, *http.Client, error) {
+	tls_config, err := self.tlsConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = self.dial()
+	transport.ResponseHeaderTimeout = self.response_header_timeout
+	if self.max_idle_conns > 0 {
+		transport.MaxIdleConnsPerHost = self.max_idle_conns
+		if transport.MaxIdleConns < self.max_idle_conns {
+			transport.MaxIdleConns = self.max_idle_conns
+		}
+	}
+	if tls_config != nil {
+		transport.TLSClientConfig = tls_config
+	}
+
+	proxy_transport := transport.Clone()
+	proxy_transport.DisableKeepAlives = true
+
+	no_redirect := func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &http.Client{Transport: transport, CheckRedirect: no_redirect},
+		&http.Client{Transport: proxy_transport, CheckRedirect: no_redirect}, nil
+}
+
+// wsDialer builds the dialer of websocket proxy
+func (self *transportConf) wsDialer() (*websocket.Dialer, error) {
+	tls_config, err := self.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &websocket.Dialer{
+		NetDialContext:   self.dial(),
+		TLSClientConfig:  tls_config,
+		HandshakeTimeout: self.response_header_timeout,
+	}, nil
+}
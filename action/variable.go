@@ -304,6 +304,28 @@ func convertActionParam(param string) (Variable, error) {
 	return ret, nil
 }
 
+func init() {
+	//hash keys of upstream groups can be variable expressions
+	env.SetKeyCompiler(func(expr string) (func(*http.Request) string, error) {
+		v, err := convertActionParam(expr)
+		if err != nil {
+			return nil, err
+		}
+		return v.Parse, nil
+	})
+}
+
+// ReferencedUpstreams returns names of upstreams referenced by {up:NAME} variables in an action string
+func ReferencedUpstreams(action string) []string {
+	ret := make([]string, 0)
+	for _, item := range matchVar.FindAllStringSubmatch(action, -1) {
+		if item[2] == "up" && item[3] == ":" {
+			ret = append(ret, item[4])
+		}
+	}
+	return ret
+}
+
 func buildVar(cmd_name string, has_param bool, param_raw string) (Variable, error) {
 	var err error
 	if cmd_name == "path" {
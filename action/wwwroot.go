@@ -1,12 +1,14 @@
 package action
 
 import (
-	"compress/gzip"
 	"errors"
 	"io"
+	"mime"
 	"net/http"
+	"os"
+	"path"
+	"strconv"
 	"strings"
-	"sync/atomic"
 )
 
 func init() {
@@ -18,11 +20,20 @@ func wwwroot(params []string, underlying http.Handler) (http.Handler, error) {
 		return nil, errors.New("wwwroor params count invalid")
 	}
 
-	return &safeWWWRoot{fs: http.FileServer(http.Dir(params[0]))}, nil
+	root := http.Dir(params[0])
+	return &safeWWWRoot{root: root, fs: http.FileServer(root)}, nil
 }
 
 type safeWWWRoot struct {
-	fs http.Handler
+	root http.FileSystem
+	fs   http.Handler
+}
+
+// file name extensions of precompressed siblings
+var gPrecompressedExt map[string]string = map[string]string{
+	"br":   ".br",
+	"zstd": ".zst",
+	"gzip": ".gz",
 }
 
 func (self *safeWWWRoot) ServeHTTP(rsp http.ResponseWriter, req *http.Request) {
@@ -46,64 +57,102 @@ func (self *safeWWWRoot) ServeHTTP(rsp http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	if acceptGZip(req) {
-		tmp := &gzipRspWriter{
-			underlying: rsp,
-			writer:     noopWriteCloser{rsp},
-		}
-		defer tmp.Close()
-		self.fs.ServeHTTP(tmp, req)
+	if self.servePrecompressed(rsp, req) {
 		return
 	}
 
-	self.fs.ServeHTTP(rsp, req)
+	writer := newCompressRspWriter(rsp, req)
+	defer writer.Close()
+	self.fs.ServeHTTP(writer, req)
 }
 
-type gzipRspWriter struct {
-	underlying http.ResponseWriter
-
-	writer io.WriteCloser
-	once   int32
-}
-
-func (self *gzipRspWriter) Header() http.Header {
-	return self.underlying.Header()
-}
-
-func (self *gzipRspWriter) WriteHeader(statusCode int) {
-	if !atomic.CompareAndSwapInt32(&(self.once), 0, 1) {
-		return
+// servePrecompressed serves a precompressed sibling of the requested file, e.g. app.js.br for
+// app.js, in the best coding the client accepts. It returns false if there is no such file.
+func (self *safeWWWRoot) servePrecompressed(rsp http.ResponseWriter, req *http.Request) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
 	}
 
-	defer self.underlying.WriteHeader(statusCode)
-
-	if len(self.underlying.Header().Values("Content-Encoding")) > 0 {
-		// do not enable gzip if content encoding is set
-		return
+	name := path.Clean("/" + req.URL.Path)
+	info, err := self.stat(name)
+	if err != nil {
+		return false
 	}
-
-	if !isTextContentType(self.underlying.Header().Get("Content-Type")) {
-		// also do not enable gzip if content type is not text
-		return
+	if info.IsDir() {
+		//directories without trailing slash are redirected by file server
+		if !strings.HasSuffix(req.URL.Path, "/") {
+			return false
+		}
+		name = path.Join(name, "index.html")
+		if info, err = self.stat(name); err != nil || info.IsDir() {
+			return false
+		}
 	}
 
-	self.underlying.Header().Set("Content-Encoding", "gzip")
-	self.underlying.Header().Del("Content-Length")
+	candidates := make([]string, 0, len(gPrecompressedExt))
+	for _, coding := range curCompression().codings {
+		if _, ok := gPrecompressedExt[coding]; ok {
+			candidates = append(candidates, coding)
+		}
+	}
 
-	self.writer = gzip.NewWriter(self.underlying)
+	for _, coding := range acceptedCodings(req, candidates) {
+		file, err := self.root.Open(name + gPrecompressedExt[coding])
+		if err != nil {
+			continue
+		}
+		stat, err := file.Stat()
+		if err != nil || !stat.Mode().IsRegular() {
+			file.Close()
+			continue
+		}
+		defer file.Close()
+
+		header := rsp.Header()
+		header.Set("Content-Type", self.contentType(name))
+		header.Set("ETag", "\""+strconv.FormatInt(stat.ModTime().UnixNano(), 36)+"-"+
+			strconv.FormatInt(stat.Size(), 36)+"-"+coding+"\"")
+		addVary(header, "Accept-Encoding")
+		http.ServeContent(&encodedFileWriter{rsp, coding}, req, name, stat.ModTime(), file)
+		return true
+	}
+	return false
 }
 
-func (self *gzipRspWriter) Write(buf []byte) (int, error) {
-	self.WriteHeader(200)
-	return self.writer.Write(buf)
+func (self *safeWWWRoot) stat(name string) (os.FileInfo, error) {
+	file, err := self.root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return file.Stat()
 }
 
-func (self *gzipRspWriter) Close() error {
-	return self.writer.Close()
+// contentType returns the content type of the original file name, as file server does
+func (self *safeWWWRoot) contentType(name string) string {
+	if ret := mime.TypeByExtension(path.Ext(name)); len(ret) > 0 {
+		return ret
+	}
+	file, err := self.root.Open(name)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer file.Close()
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(file, buf)
+	return http.DetectContentType(buf[:n])
 }
 
-type noopWriteCloser struct {
-	io.Writer
+// encodedFileWriter sets Content-Encoding when the content of a precompressed file is sent.
+// It is not set in advance, or http.ServeContent would leave out Content-Length.
+type encodedFileWriter struct {
+	http.ResponseWriter
+	coding string
 }
 
-func (self noopWriteCloser) Close() error { return nil }
+func (self *encodedFileWriter) WriteHeader(status int) {
+	if status == 200 || status == 206 {
+		self.Header().Set("Content-Encoding", self.coding)
+	}
+	self.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/zerozwt/Vert/env"
+)
+
+type routeStatus struct {
+	Rule    string   `json:"rule"`
+	Actions []string `json:"actions"`
+}
+
+type siteStatus struct {
+	Name     string        `json:"name"`
+	Listen   string        `json:"listen"`
+	Type     string        `json:"type"`
+	AutoCert bool          `json:"autocert"`
+	Routes   []routeStatus `json:"routes"`
+}
+
+type certStatus struct {
+	Name     string    `json:"name"` // site name, _default for default certificate of a listen address
+	Listen   string    `json:"listen,omitempty"`
+	AutoCert bool      `json:"autocert"`
+	SSLCert  string    `json:"ssl_cert,omitempty"`
+	NotAfter time.Time `json:"not_after,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+var gAdminServer *http.Server
+
+// checkAdminListen only allows admin API on loopback addresses and unix sockets
+func checkAdminListen(addr string, token string) error {
+	if len(addr) == 0 {
+		return nil
+	}
+	if len(token) == 0 {
+		return errors.New("admin_token is required by admin_listen")
+	}
+	if strings.HasPrefix(addr, "unix:") {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.New("Invalid admin_listen " + addr + ": " + err.Error())
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return errors.New("Invalid admin_listen " + addr + ": only loopback address or unix socket is allowed")
+	}
+	return nil
+}
+
+// startAdmin serves admin API on addr, reloads are sent to the main loop via reload
+func startAdmin(addr string, reload chan chan error) error {
+	if len(addr) == 0 {
+		return nil
+	}
+
+	ln, err := listen(&serverSlot{listen: addr, mode: 0600})
+	if err != nil {
+		return err
+	}
+
+	gAdminServer = &http.Server{
+		Handler:           adminHandler(reload),
+		ReadHeaderTimeout: defaultReadHeaderTimeout,
+		IdleTimeout:       defaultIdleTimeout,
+	}
+	INFO_LOG("Start admin API on %s ...", addr)
+	go gAdminServer.Serve(ln)
+	return nil
+}
+
+func stopAdmin() {
+	if gAdminServer != nil {
+		gAdminServer.Close()
+	}
+}
+
+func adminHandler(reload chan chan error) http.Handler {
+	router := mux.NewRouter()
+	router.HandleFunc("/sites", adminSites).Methods(http.MethodGet)
+	router.HandleFunc("/upstreams", adminUpstreams).Methods(http.MethodGet)
+	router.HandleFunc("/upstreams/{group}/{addr}/{op:drain|enable|weight}", adminEntry).Methods(http.MethodPost)
+	router.HandleFunc("/certs", adminCerts).Methods(http.MethodGet)
+	router.HandleFunc("/reload", func(rsp http.ResponseWriter, req *http.Request) {
+		INFO_LOG("reload requested by admin API")
+		ch_ret := make(chan error)
+		reload <- ch_ret
+		if err := <-ch_ret; err != nil {
+			ERROR_LOG("reload config failed, keep running with old config: %v", err)
+			adminError(rsp, http.StatusInternalServerError, err)
+			return
+		}
+		INFO_LOG("reload config succeed")
+		adminJSON(rsp, map[string]bool{"ok": true})
+	}).Methods(http.MethodPost)
+
+	return http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		//token is read on every request, so that it can be changed by reload
+		token := curConf().Base.AdminToken
+		auth := req.Header.Get("Authorization")
+		if len(token) == 0 || !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+			adminError(rsp, http.StatusUnauthorized, errors.New("invalid admin token"))
+			return
+		}
+		router.ServeHTTP(rsp, req)
+	})
+}
+
+func adminJSON(rsp http.ResponseWriter, value interface{}) {
+	rsp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rsp).Encode(value)
+}
+
+func adminError(rsp http.ResponseWriter, status int, err error) {
+	rsp.Header().Set("Content-Type", "application/json")
+	rsp.WriteHeader(status)
+	json.NewEncoder(rsp).Encode(map[string]string{"error": err.Error()})
+}
+
+func adminSites(rsp http.ResponseWriter, req *http.Request) {
+	ret := make([]siteStatus, 0)
+	if rt, ok := gRuntime.Load().(*vertRuntime); ok {
+		listens := make([]string, 0, len(rt.slots))
+		for listen := range rt.slots {
+			listens = append(listens, listen)
+		}
+		sort.Strings(listens)
+		for _, listen := range listens {
+			ret = append(ret, rt.slots[listen].sites...)
+		}
+	}
+	adminJSON(rsp, ret)
+}
+
+func adminUpstreams(rsp http.ResponseWriter, req *http.Request) {
+	adminJSON(rsp, env.UpstreamStatus())
+}
+
+func adminEntry(rsp http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	group, addr := vars["group"], vars["addr"]
+
+	var status env.EntryStatus
+	var err error
+	switch vars["op"] {
+	case "drain":
+		status, err = env.DrainEntry(group, addr, true)
+	case "enable":
+		status, err = env.DrainEntry(group, addr, false)
+	case "weight":
+		weight, parse_err := strconv.Atoi(req.URL.Query().Get("weight"))
+		if parse_err != nil {
+			adminError(rsp, http.StatusBadRequest, errors.New("invalid weight "+req.URL.Query().Get("weight")))
+			return
+		}
+		status, err = env.SetEntryWeight(group, addr, weight)
+	}
+
+	if err != nil {
+		adminError(rsp, http.StatusBadRequest, err)
+		return
+	}
+	adminJSON(rsp, status)
+}
+
+func adminCerts(rsp http.ResponseWriter, req *http.Request) {
+	store := curCertInfo()
+	ret := make([]certStatus, 0)
+
+	names := make([]string, 0, len(store.names))
+	for name := range store.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ret = append(ret, newCertStatus(req.Context(), name, "", store.names[name]))
+	}
+
+	for _, item := range store.patterns {
+		ret = append(ret, newCertStatus(req.Context(), item.name, "", item.info))
+	}
+
+	listens := make([]string, 0, len(store.defaults))
+	for listen := range store.defaults {
+		listens = append(listens, listen)
+	}
+	sort.Strings(listens)
+	for _, listen := range listens {
+		ret = append(ret, newCertStatus(req.Context(), defaultSiteName, listen, store.defaults[listen]))
+	}
+
+	adminJSON(rsp, ret)
+}
+
+func newCertStatus(ctx context.Context, name string, listen string, info certInfo) certStatus {
+	ret := certStatus{Name: name, Listen: listen, AutoCert: info.AutoCert, SSLCert: info.SSLCert}
+
+	if !info.AutoCert {
+		cert, err := gStaticCertManager.Get(info.SSLCert, info.SSLKey)
+		if err != nil {
+			ret.Error = err.Error()
+		} else if cert.Leaf != nil {
+			ret.NotAfter = cert.Leaf.NotAfter
+		}
+		return ret
+	}
+
+	//autocert certificates can only be inspected from cache, they may be not issued yet
+	if gCertManager == nil || gCertManager.Cache == nil {
+		return ret
+	}
+	data, err := gCertManager.Cache.Get(ctx, name)
+	if err != nil {
+		ret.Error = err.Error()
+		return ret
+	}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if leaf, err := x509.ParseCertificate(block.Bytes); err == nil {
+			ret.NotAfter = leaf.NotAfter
+		} else {
+			ret.Error = err.Error()
+		}
+		break
+	}
+	return ret
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zerozwt/Vert/env"
+)
+
+func TestAdminListen(t *testing.T) {
+	cases := []struct {
+		addr  string
+		token string
+		ok    bool
+	}{
+		{"", "", true},
+		{"127.0.0.1:9000", "secret", true},
+		{"[::1]:9000", "secret", true},
+		{"localhost:9000", "secret", true},
+		{"unix:/run/vert-admin.sock", "secret", true},
+		{"127.0.0.1:9000", "", false},
+		{":9000", "secret", false},
+		{"10.0.0.1:9000", "secret", false},
+		{"systemd:admin", "secret", false},
+	}
+	for _, item := range cases {
+		if err := checkAdminListen(item.addr, item.token); (err == nil) != item.ok {
+			t.Errorf("check admin_listen %s not as expected: %v", item.addr, err)
+		}
+	}
+}
+
+func TestReloadAdminListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vert_admin")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &Conf{}
+	conf.Base.AdminListen = "127.0.0.1:9000"
+	conf.Base.AdminToken = "secret"
+	setConf(conf)
+
+	gConfFile = filepath.Join(dir, "conf.yaml")
+	ioutil.WriteFile(gConfFile, []byte(`
+base:
+  admin_listen: 127.0.0.1:9001
+  admin_token: secret
+`), 0600)
+
+	if err := reload(); err == nil || !strings.Contains(err.Error(), "admin_listen") {
+		t.Errorf("changing admin_listen by reload should fail: %v", err)
+	}
+	if curConf() != conf {
+		t.Errorf("running config should be kept after failed reload")
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	conf := &Conf{}
+	conf.Base.AdminToken = "secret"
+	setConf(conf)
+
+	if err := env.AddUpsteam(map[string][]string{"admin_test": {"A weight=2", "B"}}); err != nil {
+		t.Errorf("build upstream failed: %v", err)
+		return
+	}
+
+	handler := adminHandler(make(chan chan error))
+	call := func(method string, path string, token string, value interface{}) int {
+		req := httptest.NewRequest(method, path, nil)
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rsp := httptest.NewRecorder()
+		handler.ServeHTTP(rsp, req)
+		if value != nil && rsp.Code == http.StatusOK {
+			if err := json.Unmarshal(rsp.Body.Bytes(), value); err != nil {
+				t.Errorf("decode response of %s failed: %v", path, err)
+			}
+		}
+		return rsp.Code
+	}
+
+	if code := call("GET", "/upstreams", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("request without token should be rejected: %d", code)
+	}
+	if code := call("GET", "/upstreams", "wrong", nil); code != http.StatusUnauthorized {
+		t.Errorf("request with wrong token should be rejected: %d", code)
+	}
+
+	find := func() *env.EntryStatus {
+		groups := make([]env.GroupStatus, 0)
+		if code := call("GET", "/upstreams", "secret", &groups); code != http.StatusOK {
+			t.Errorf("list upstreams failed: %d", code)
+			return nil
+		}
+		for _, group := range groups {
+			if group.Name == "admin_test" && len(group.Entries) == 2 && group.Entries[0].Addr == "A" {
+				return &group.Entries[0]
+			}
+		}
+		t.Errorf("upstream admin_test not listed: %v", groups)
+		return nil
+	}
+
+	if entry := find(); entry == nil || entry.Weight != 2 || entry.Drained || !entry.Available {
+		t.Errorf("status of entry A not as expected: %v", entry)
+		return
+	}
+
+	//drained entry gets no new request
+	if code := call("POST", "/upstreams/admin_test/A/drain", "secret", nil); code != http.StatusOK {
+		t.Errorf("drain entry failed: %d", code)
+	}
+	for i := 0; i < 4; i++ {
+		if addr := env.UpstreamAddr("admin_test", nil); addr != "B" {
+			t.Errorf("drained entry should not be used: %s", addr)
+			return
+		}
+	}
+	if entry := find(); entry == nil || !entry.Drained || entry.Available {
+		t.Errorf("status of drained entry not as expected: %v", entry)
+	}
+
+	//weight change keeps drain state
+	if code := call("POST", "/upstreams/admin_test/A/weight?weight=5", "secret", nil); code != http.StatusOK {
+		t.Errorf("change weight failed: %d", code)
+	}
+	if entry := find(); entry == nil || entry.Weight != 5 || !entry.Drained {
+		t.Errorf("status of reweighted entry not as expected: %v", entry)
+	}
+
+	if code := call("POST", "/upstreams/admin_test/A/enable", "secret", nil); code != http.StatusOK {
+		t.Errorf("enable entry failed: %d", code)
+	}
+	if entry := find(); entry == nil || entry.Drained || !entry.Available {
+		t.Errorf("status of enabled entry not as expected: %v", entry)
+	}
+
+	if code := call("POST", "/upstreams/admin_test/C/drain", "secret", nil); code != http.StatusBadRequest {
+		t.Errorf("drain unknown entry should fail: %d", code)
+	}
+	if code := call("POST", "/upstreams/admin_test/A/weight?weight=0", "secret", nil); code != http.StatusBadRequest {
+		t.Errorf("invalid weight should fail: %d", code)
+	}
+}
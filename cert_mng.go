@@ -2,14 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/crypto/ocsp"
 )
@@ -21,6 +26,20 @@ type certInfo struct {
 	SSLCert string
 }
 
+type certPattern struct {
+	name  string
+	route *mux.Route // only matches host
+	info  certInfo
+}
+
+// certStore finds cert info of a TLS server name: exact site names first, then wildcard
+// sites from the most specific one, then the _default site of the port
+type certStore struct {
+	names    map[string]certInfo
+	patterns []certPattern
+	defaults map[string]certInfo // key: listen address
+}
+
 type ocspInfo struct {
 	data   []byte
 	expire time.Time
@@ -36,7 +55,7 @@ type staticCertManager struct {
 	cache map[[2]string]*tls.Certificate // key: [cert_file, key_file]
 }
 
-var gCertInfo map[string]certInfo = make(map[string]certInfo)
+var gCertInfo atomic.Value // *certStore
 var gCertManager *autocert.Manager
 
 var gOCSPManager *ocspManager = &ocspManager{
@@ -49,30 +68,106 @@ var gStaticCertManager *staticCertManager = &staticCertManager{
 
 func initCertManager() {
 	gCertManager = &autocert.Manager{
-		Prompt: autocert.AcceptTOS,
-		Email:  gConf.Base.TlsEmail,
+		Prompt:     autocert.AcceptTOS,
+		Email:      curConf().Base.TlsEmail,
+		HostPolicy: certHostPolicy,
 	}
-	if len(gConf.Base.CertCache) != 0 {
-		gCertManager.Cache = autocert.DirCache(gConf.Base.CertCache)
+	if len(curConf().Base.CertCache) != 0 {
+		gCertManager.Cache = autocert.DirCache(curConf().Base.CertCache)
 	}
 }
 
-func setCertInfo(name string, info certInfo) error {
-	if _, ok := gCertInfo[name]; ok {
+func newCertStore() *certStore {
+	return &certStore{
+		names:    make(map[string]certInfo),
+		patterns: make([]certPattern, 0),
+		defaults: make(map[string]certInfo),
+	}
+}
+
+// Add registers cert info of a site, wildcard sites should be added from the most specific one.
+// A site on several listen addresses is added once for each of them, with the same cert info.
+func (self *certStore) Add(name string, listen string, info certInfo) error {
+	if name == defaultSiteName {
+		if info.AutoCert {
+			return errors.New("autocert is not available for " + defaultSiteName + " site")
+		}
+		if _, ok := self.defaults[listen]; ok {
+			return errors.New("Duplicate cert info: " + name)
+		}
+		self.defaults[listen] = info
+		return nil
+	}
+
+	if isWildcardHost(name) {
+		if info.AutoCert {
+			return errors.New("autocert cannot issue certificate for wildcard site " + name)
+		}
+		for _, item := range self.patterns {
+			if item.name == name {
+				if item.info != info {
+					return errors.New("Duplicate cert info: " + name)
+				}
+				return nil
+			}
+		}
+		route := mux.NewRouter().Host(hostTemplate(name))
+		if err := route.GetError(); err != nil {
+			return err
+		}
+		self.patterns = append(self.patterns, certPattern{name: name, route: route, info: info})
+		return nil
+	}
+
+	if exist, ok := self.names[name]; ok && exist != info {
 		return errors.New("Duplicate cert info: " + name)
 	}
-	gCertInfo[name] = info
+	self.names[name] = info
 	return nil
 }
 
-func certManagerWhitelist(hosts ...string) {
-	gCertManager.HostPolicy = autocert.HostWhitelist(hosts...)
+func (self *certStore) Lookup(name string, listen string) (certInfo, bool) {
+	if info, ok := self.names[name]; ok {
+		return info, true
+	}
+
+	req := &http.Request{Host: name, URL: &url.URL{}}
+	for _, item := range self.patterns {
+		if item.route.Match(req, &mux.RouteMatch{}) {
+			return item.info, true
+		}
+	}
+
+	info, ok := self.defaults[listen]
+	return info, ok
+}
+
+// setCertInfo swaps in the cert info of a newly built config, static certificates are
+// reloaded from disk on next handshake
+func setCertInfo(certs *certStore) {
+	gCertInfo.Store(certs)
+	gStaticCertManager.Reset()
+}
+
+func curCertInfo() *certStore {
+	if ret, ok := gCertInfo.Load().(*certStore); ok {
+		return ret
+	}
+	return newCertStore()
+}
+
+func certHostPolicy(ctx context.Context, host string) error {
+	if info, ok := curCertInfo().names[host]; ok && info.AutoCert {
+		return nil
+	}
+	return errors.New("acme/autocert: host \"" + host + "\" not configured for autocert")
 }
 
-func getCert(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+// getCert finds certificate for a TLS handshake on listen address
+func getCert(hello *tls.ClientHelloInfo, listen string) (*tls.Certificate, error) {
 	name := hello.ServerName
 
-	info, ok := gCertInfo[name]
+	info, ok := curCertInfo().Lookup(name, listen)
 	if !ok {
 		ERROR_LOG("No certificates available for %s", name)
 		return nil, errors.New("No certificates available for " + name)
@@ -93,6 +188,11 @@ func getCert(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 		return nil, err
 	}
 
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto {
+		// TLS-ALPN-01 challenge certificate, which has no OCSP
+		return cert, nil
+	}
+
 	ocsp, err := getOCSP(name, cert)
 	if err != nil {
 		ERROR_LOG("Get OCSP for %s failed: %v", name, err)
@@ -183,6 +283,13 @@ func (self *ocspManager) Set(name string, data []byte, expire time.Time) {
 	}
 }
 
+func (self *staticCertManager) Reset() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.cache = make(map[[2]string]*tls.Certificate)
+}
+
 func (self *staticCertManager) Get(certFile, keyFile string) (*tls.Certificate, error) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/zerozwt/Vert/action"
+	"github.com/zerozwt/Vert/env"
+)
+
+// confError locates an error in config file
+type confError struct {
+	site   string
+	listen string
+	rule   string
+	action int // index in action list of the rule, -1 if not caused by an action
+	err    error
+}
+
+func (self *confError) Error() string {
+	ret := self.site
+	if strings.HasPrefix(self.listen, ":") {
+		ret += self.listen
+	} else if len(self.listen) > 0 {
+		ret += "@" + self.listen
+	}
+	if len(self.rule) > 0 {
+		ret += " rule '" + self.rule + "'"
+	}
+	if self.action >= 0 {
+		ret += fmt.Sprintf(" action #%d", self.action)
+	}
+	return ret + ": " + self.err.Error()
+}
+
+func siteError(site string, listen string, err error) *confError {
+	return &confError{site: site, listen: listen, action: -1, err: err}
+}
+
+// confErrors collects all errors found in config instead of stopping at the first one
+type confErrors []error
+
+func (self confErrors) Error() string {
+	tmp := make([]string, 0, len(self))
+	for _, err := range self {
+		tmp = append(tmp, err.Error())
+	}
+	return strings.Join(tmp, "\n")
+}
+
+func (self *confErrors) Add(err error) {
+	if list, ok := err.(confErrors); ok {
+		*self = append(*self, list...)
+		return
+	}
+	*self = append(*self, err)
+}
+
+func (self confErrors) Err() error {
+	if len(self) == 0 {
+		return nil
+	}
+	return self
+}
+
+func sortedSiteNames(sites map[string][]SiteConf) []string {
+	ret := make([]string, 0, len(sites))
+	for name := range sites {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// checkConf validates config file offline, and returns every error found in it
+func checkConf(conf_file string) confErrors {
+	errs := confErrors{}
+
+	conf, err := loadConf(conf_file)
+	if err != nil {
+		errs.Add(err)
+		return errs
+	}
+
+	//build upstream groups one by one, so that all malformed groups are reported
+	upstream_names := make(map[string]bool)
+	for key, entry_list := range conf.Upstream {
+		upstream_names[upstreamName(key)] = true
+		if _, err := env.BuildUpstream(map[string][]string{key: entry_list}); err != nil {
+			errs.Add(fmt.Errorf("upstream '%s': %v", strings.TrimSpace(key), err))
+		}
+	}
+
+	if _, _, err := buildServerSlots(conf); err != nil {
+		errs.Add(err)
+	}
+
+	//a wildcard address and a specific address on the same port cannot be bound together
+	port_hosts := make(map[string]map[string]bool)
+	for _, name := range sortedSiteNames(conf.Sites) {
+		for _, site := range conf.Sites[name] {
+			if host, port, err := net.SplitHostPort(site.Listen); err == nil && !isSocketListen(site.Listen) {
+				if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+					host = ""
+				}
+				if port_hosts[port] == nil {
+					port_hosts[port] = make(map[string]bool)
+				}
+				port_hosts[port][host] = true
+			}
+		}
+	}
+	for port, hosts := range port_hosts {
+		if hosts[""] && len(hosts) > 1 {
+			errs.Add(fmt.Errorf("port %s is listened on all addresses and specific addresses at the same time", port))
+		}
+	}
+
+	//cross checks which are not covered by building
+	for _, name := range sortedSiteNames(conf.Sites) {
+		for _, site := range conf.Sites[name] {
+			if isTls(site.Type) && !site.AutoCert {
+				if _, err := tls.LoadX509KeyPair(site.SSLCert, site.SSLKey); err != nil {
+					errs.Add(siteError(name, site.Listen, fmt.Errorf("load ssl_cert/ssl_key failed: %v", err)))
+				}
+			}
+
+			for _, rule := range site.Rules {
+				for idx, item := range rule.Actions {
+					for _, up := range action.ReferencedUpstreams(item) {
+						if !upstream_names[up] {
+							errs.Add(&confError{site: name, listen: site.Listen, rule: rule.Key, action: idx,
+								err: fmt.Errorf("upstream '%s' is not defined", up)})
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+func runCheck() int {
+	errs := checkConf(gConfFile)
+	if len(errs) == 0 {
+		fmt.Println(gConfFile + ": config OK")
+		return 0
+	}
+
+	for _, err := range errs {
+		fmt.Println(err)
+	}
+	fmt.Printf("%s: %d error(s) found\n", gConfFile, len(errs))
+	return 1
+}
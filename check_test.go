@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vert_check")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	conf_file := filepath.Join(dir, "conf.yaml")
+	ioutil.WriteFile(conf_file, []byte(`
+base:
+  acme_http: "off"
+upstream:
+  up_main:
+    - 127.0.0.1:8000
+sites:
+  a.example.com:
+    - port: 8080
+      type: http
+      rules:
+        - /api/:
+          - proxy http://{up:up_main}/
+          - proxy http://{up:missing}/
+  b.example.com:
+    - port: 8443
+      type: https
+      ssl_cert: `+filepath.Join(dir, "cert.pem")+`
+      ssl_key: `+filepath.Join(dir, "key.pem")+`
+      rules:
+        - /:
+          - wwwroot /tmp
+  c.example.com:
+    - port: 8080
+      type: http
+      rules:
+        - /:
+          - wwwroot /tmp
+    - port: 8080
+      type: http
+      rules:
+        - /:
+          - wwwroot /tmp
+  d.example.com:
+    - port: 8080
+      type: http
+      rules:
+        - /static/:
+          - wwwroot /tmp
+          - nosuchaction foo
+`), 0600)
+
+	expects := []struct {
+		site   string
+		listen string
+		rule   string
+		action int
+		err    string
+	}{
+		{"a.example.com", ":8080", "/api/", 1, "upstream 'missing' is not defined"},
+		{"b.example.com", ":8443", "", -1, "load ssl_cert/ssl_key failed"},
+		{"c.example.com", ":8080", "", -1, "duplicate site"},
+		{"d.example.com", ":8080", "/static/", 1, "Invalid action"},
+	}
+
+	errs := checkConf(conf_file)
+	if len(errs) != len(expects) {
+		t.Errorf("error count not as expected: expected=%d actual=%d\n%v", len(expects), len(errs), errs)
+	}
+	for _, expect := range expects {
+		found := false
+		for _, err := range errs {
+			item, ok := err.(*confError)
+			if ok && item.site == expect.site && item.listen == expect.listen && item.rule == expect.rule &&
+				item.action == expect.action && strings.Contains(item.err.Error(), expect.err) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("error of %s not reported: %s\n%v", expect.site, expect.err, errs)
+		}
+	}
+}
@@ -4,11 +4,15 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
-	"github.com/zerozwt/Vert/env"
+	"github.com/zerozwt/Vert/action"
 	"gopkg.in/yaml.v2"
 )
 
@@ -16,15 +20,119 @@ type SiteConf struct {
 	Type string `yaml:"type"`
 	Port int    `yaml:"port"`
 
+	Listen      string `yaml:"listen"`
+	SocketMode  string `yaml:"socket_mode"`
+	iSocketMode os.FileMode
+
+	ProxyProtocol bool `yaml:"proxy_protocol"` // connections of the listen address start with PROXY protocol headers
+
+	Limits       ServerLimits `yaml:",inline"`
+	MaxBodySize  string       `yaml:"max_body_size"`
+	iMaxBodySize int64
+
 	AutoCert bool `yaml:"autocert"`
 
 	SSLKey  string `yaml:"ssl_key"`
 	SSLCert string `yaml:"ssl_cert"`
 
-	Rules []map[string][]string `yaml:"rules"`
+	LongestPrefix bool     `yaml:"longest_prefix"`
+	Rules         RuleList `yaml:"rules"`
+}
+
+// ServerLimits are settings of http.Server, sites sharing a listen address should not
+// set different values. Zero values mean not set.
+type ServerLimits struct {
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	MaxHeaderBytes    string        `yaml:"max_header_bytes"`
+	iMaxHeaderBytes   int64
+}
+
+const defaultReadHeaderTimeout time.Duration = time.Second * 30
+const defaultIdleTimeout time.Duration = time.Second * 300
+
+// merge sets values of other into self, and fails if both set a field with different values
+func (self *ServerLimits) merge(other ServerLimits) error {
+	durations := []struct {
+		name  string
+		dst   *time.Duration
+		value time.Duration
+	}{
+		{"read_header_timeout", &self.ReadHeaderTimeout, other.ReadHeaderTimeout},
+		{"read_timeout", &self.ReadTimeout, other.ReadTimeout},
+		{"write_timeout", &self.WriteTimeout, other.WriteTimeout},
+		{"idle_timeout", &self.IdleTimeout, other.IdleTimeout},
+	}
+	for _, item := range durations {
+		if item.value == 0 {
+			continue
+		}
+		if *item.dst != 0 && *item.dst != item.value {
+			return errors.New(item.name + " conflicts with existing sites")
+		}
+		*item.dst = item.value
+	}
+
+	if other.iMaxHeaderBytes != 0 {
+		if self.iMaxHeaderBytes != 0 && self.iMaxHeaderBytes != other.iMaxHeaderBytes {
+			return errors.New("max_header_bytes conflicts with existing sites")
+		}
+		self.iMaxHeaderBytes = other.iMaxHeaderBytes
+		self.MaxHeaderBytes = other.MaxHeaderBytes
+	}
+	return nil
+}
+
+type RuleConf struct {
+	Key     string // path optionally followed by matchers, see routeSpec
+	Actions []string
+}
+
+// RuleList keeps rules in the order they are written in config file, even if
+// several rules are written under one list item
+type RuleList []RuleConf
+
+func (self *RuleList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	raw := make([]yaml.MapSlice, 0)
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	ret := make(RuleList, 0)
+	for _, item := range raw {
+		for _, kv := range item {
+			key, ok := kv.Key.(string)
+			if !ok {
+				return fmt.Errorf("rule %v is not a string", kv.Key)
+			}
+
+			rule := RuleConf{Key: key, Actions: make([]string, 0)}
+			if kv.Value != nil {
+				action_list, ok := kv.Value.([]interface{})
+				if !ok {
+					return errors.New("actions of rule " + key + " is not a list")
+				}
+				for _, value := range action_list {
+					str, ok := value.(string)
+					if !ok {
+						return fmt.Errorf("action %v of rule %s is not a string", value, key)
+					}
+					rule.Actions = append(rule.Actions, str)
+				}
+			}
+			ret = append(ret, rule)
+		}
+	}
+
+	*self = ret
+	return nil
 }
 
 type Conf struct {
+	Include []string `yaml:"include"` // glob patterns of files containing more upstreams and sites
+
 	Base struct {
 		LogLevel  string `yaml:"log_level"`
 		iLogLevel int
@@ -32,30 +140,87 @@ type Conf struct {
 
 		TlsEmail  string `yaml:"tls_email"`
 		CertCache string `yaml:"cert_cache"`
+
+		DrainTimeout time.Duration `yaml:"drain_timeout"`
+
+		AcmeHttp string `yaml:"acme_http"` // listen address of ACME HTTP-01 challenges
+
+		StickySecret string `yaml:"sticky_secret"` // key signing sticky session cookies
+
+		AdminListen string `yaml:"admin_listen"` // loopback address or unix socket of admin API
+		AdminToken  string `yaml:"admin_token"`
+
+		TrustedProxies  []string `yaml:"trusted_proxies"` // peers whose forwarding headers are kept
+		iTrustedProxies *action.TrustedProxies
+
+		Compression struct {
+			Codings   []string       `yaml:"codings"` // in order of preference
+			Level     map[string]int `yaml:"level"`
+			MinLength string         `yaml:"min_length"`
+			Types     []string       `yaml:"types"`
+		} `yaml:"compression"`
+		iCompression *action.Compression
 	} `yaml:"base"`
 	Upstream map[string][]string   `yaml:"upstream"`
 	Sites    map[string][]SiteConf `yaml:"sites"`
 }
 
-var gConf Conf
+const defaultDrainTimeout time.Duration = time.Second * 30
+const defaultAcmeHttp string = ":80"
+const acmeHttpOff string = "off"
+
+var gConf atomic.Value // *Conf
+var gConfFile string
+var gCheckOnly bool
 
-func loadConf() error {
-	conf_file := ""
-	flag.StringVar(&conf_file, "conf", "", "config file")
+func curConf() *Conf {
+	if ret, ok := gConf.Load().(*Conf); ok {
+		return ret
+	}
+	return &Conf{}
+}
+
+func setConf(conf *Conf) { gConf.Store(conf) }
+
+func parseFlags() {
+	flag.StringVar(&gConfFile, "conf", "", "config file")
+	flag.BoolVar(&gCheckOnly, "check", false, "validate config file and exit")
 	flag.Parse()
 
-	if conf_file == "" {
-		conf_file, _ = filepath.Abs(filepath.Dir(os.Args[0]))
-		conf_file = filepath.Join(conf_file, "conf.yaml")
+	if gConfFile == "" {
+		gConfFile, _ = filepath.Abs(filepath.Dir(os.Args[0]))
+		gConfFile = filepath.Join(gConfFile, "conf.yaml")
 	}
+}
 
-	conf_data, err := ioutil.ReadFile(conf_file)
+func loadConf(conf_file string) (*Conf, error) {
+	ret, err := readConfFile(conf_file)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err := mergeIncludes(ret, conf_file); err != nil {
+		return nil, err
 	}
 
-	if err = yaml.Unmarshal(conf_data, &gConf); err != nil {
-		return err
+	if ret.Base.TlsEmail, err = action.ReadSecret(ret.Base.TlsEmail); err != nil {
+		return nil, errors.New("read tls_email failed: " + err.Error())
+	}
+	if ret.Base.StickySecret, err = action.ReadSecret(ret.Base.StickySecret); err != nil {
+		return nil, errors.New("read sticky_secret failed: " + err.Error())
+	}
+	if ret.Base.AdminToken, err = action.ReadSecret(ret.Base.AdminToken); err != nil {
+		return nil, errors.New("read admin_token failed: " + err.Error())
+	}
+	if err := checkAdminListen(ret.Base.AdminListen, ret.Base.AdminToken); err != nil {
+		return nil, err
+	}
+	if ret.Base.iTrustedProxies, err = action.ParseTrustedProxies(ret.Base.TrustedProxies); err != nil {
+		return nil, err
+	}
+	compression := &ret.Base.Compression
+	if ret.Base.iCompression, err = action.ParseCompression(compression.Codings, compression.Level,
+		compression.MinLength, compression.Types); err != nil {
+		return nil, err
 	}
 
 	log_level := map[string]int{
@@ -64,55 +229,150 @@ func loadConf() error {
 		"error": 3,
 	}
 
-	if n, ok := log_level[gConf.Base.LogLevel]; ok {
-		gConf.Base.iLogLevel = n
+	if n, ok := log_level[ret.Base.LogLevel]; ok {
+		ret.Base.iLogLevel = n
 	}
 
-	if err = env.AddUpsteam(gConf.Upstream); err != nil {
-		return err
+	if ret.Base.DrainTimeout <= 0 {
+		ret.Base.DrainTimeout = defaultDrainTimeout
+	}
+
+	if len(ret.Base.AcmeHttp) == 0 {
+		ret.Base.AcmeHttp = defaultAcmeHttp
+	}
+	if ret.Base.AcmeHttp != acmeHttpOff {
+		tmp := SiteConf{Listen: ret.Base.AcmeHttp}
+		if err := normalizeListen(&tmp); err != nil || isSocketListen(tmp.Listen) {
+			return nil, errors.New("Invalid acme_http " + ret.Base.AcmeHttp)
+		}
+		ret.Base.AcmeHttp = tmp.Listen
 	}
 
 	//check site conf
 	sites := make(map[string][]SiteConf)
-	for domain, conf_list := range gConf.Sites {
+	errs := confErrors{}
+	for _, domain := range sortedSiteNames(ret.Sites) {
 		tmp := make([]SiteConf, 0)
-		for _, conf := range conf_list {
+		for _, conf := range ret.Sites[domain] {
+			if err := normalizeListen(&conf); err != nil {
+				errs.Add(siteError(domain, conf.Listen, err))
+				continue
+			}
+
 			site_type := conf.Type
 			port := conf.Port
+			socket := isSocketListen(conf.Listen)
 			if site_type == "" {
 				if port == 80 {
 					site_type = "http"
 				} else if port == 443 {
 					site_type = "https"
 				} else {
-					return errors.New("Cannot automatically determine type of " + domain + ":" + fmt.Sprint(port))
+					errs.Add(siteError(domain, conf.Listen, errors.New("Cannot automatically determine type of "+domain+":"+fmt.Sprint(port))))
+					continue
 				}
 			}
-			if port == 0 {
+			if port == 0 && !socket {
 				if site_type == "http" {
 					port = 80
 				} else if site_type == "https" {
 					port = 443
 				} else {
-					return errors.New("Cannot automatically determine port of " + domain)
+					errs.Add(siteError(domain, conf.Listen, errors.New("Cannot automatically determine port of "+domain)))
+					continue
 				}
 			}
-			if port < 1 || port > 65535 {
-				return errors.New("Invalid port " + fmt.Sprint(port) + " of " + domain)
+			if !socket && (port < 1 || port > 65535) {
+				errs.Add(siteError(domain, "", errors.New("Invalid port "+fmt.Sprint(port)+" of "+domain)))
+				continue
+			}
+			if len(conf.Listen) == 0 {
+				conf.Listen = fmt.Sprintf(":%d", port)
 			}
 
-			tmp = append(tmp, SiteConf{
-				Type:     site_type,
-				Port:     port,
-				AutoCert: conf.AutoCert,
-				SSLKey:   conf.SSLKey,
-				SSLCert:  conf.SSLCert,
-				Rules:    conf.Rules,
-			})
+			var err error
+			if len(conf.Limits.MaxHeaderBytes) > 0 {
+				if conf.Limits.iMaxHeaderBytes, err = action.ParseSize(conf.Limits.MaxHeaderBytes); err != nil {
+					errs.Add(siteError(domain, conf.Listen, errors.New("Invalid max_header_bytes "+conf.Limits.MaxHeaderBytes)))
+					continue
+				}
+			}
+			if len(conf.MaxBodySize) > 0 {
+				if conf.iMaxBodySize, err = action.ParseSize(conf.MaxBodySize); err != nil {
+					errs.Add(siteError(domain, conf.Listen, errors.New("Invalid max_body_size "+conf.MaxBodySize)))
+					continue
+				}
+			}
+
+			conf.Type = site_type
+			conf.Port = port
+			tmp = append(tmp, conf)
 		}
 		sites[domain] = tmp
 	}
-	gConf.Sites = sites
+	ret.Sites = sites
+
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// isSocketListen tells whether a listen address is a unix socket or a systemd socket, which have no port
+func isSocketListen(listen string) bool {
+	return strings.HasPrefix(listen, "unix:") || strings.HasPrefix(listen, "systemd:")
+}
+
+// normalizeListen checks listen address of a site, and fills port of the site from it
+func normalizeListen(conf *SiteConf) error {
+	if len(conf.SocketMode) > 0 {
+		mode, err := strconv.ParseUint(conf.SocketMode, 8, 32)
+		if err != nil || mode > 0777 {
+			return errors.New("Invalid socket_mode " + conf.SocketMode)
+		}
+		conf.iSocketMode = os.FileMode(mode)
+	}
+
+	if len(conf.Listen) == 0 {
+		if len(conf.SocketMode) > 0 {
+			return errors.New("socket_mode is only available for unix socket")
+		}
+		return nil
+	}
+
+	if isSocketListen(conf.Listen) {
+		if conf.Port != 0 {
+			return errors.New("port cannot be used with listen " + conf.Listen)
+		}
+		if len(conf.SocketMode) > 0 && !strings.HasPrefix(conf.Listen, "unix:") {
+			return errors.New("socket_mode is only available for unix socket")
+		}
+		if len(conf.Listen) == strings.Index(conf.Listen, ":")+1 {
+			return errors.New("Invalid listen address " + conf.Listen)
+		}
+		return nil
+	}
+
+	if len(conf.SocketMode) > 0 {
+		return errors.New("socket_mode is only available for unix socket")
+	}
+
+	host, port_str, err := net.SplitHostPort(conf.Listen)
+	if err != nil {
+		return err
+	}
+	if len(host) > 0 && net.ParseIP(host) == nil {
+		return errors.New("listen address should be an IP address: " + conf.Listen)
+	}
+	port, err := strconv.Atoi(port_str)
+	if err != nil {
+		return errors.New("Invalid listen address " + conf.Listen)
+	}
+	if conf.Port != 0 && conf.Port != port {
+		return fmt.Errorf("port %d conflicts with listen %s", conf.Port, conf.Listen)
+	}
 
+	conf.Port = port
+	conf.Listen = net.JoinHostPort(host, port_str)
 	return nil
 }
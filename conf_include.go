@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var matchEnvVar *regexp.Regexp = regexp.MustCompile(`\$\$\{|\$\{([^\}]*)\}`)
+var matchEnvName *regexp.Regexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// expandEnv replaces ${NAME} and ${NAME:-default} with environment variables, "$${" is kept as "${"
+func expandEnv(data string) (string, error) {
+	var err error
+	ret := matchEnvVar.ReplaceAllStringFunc(data, func(item string) string {
+		if item == "$${" {
+			return "${"
+		}
+
+		name, def, has_def := item[2:len(item)-1], "", false
+		if idx := strings.Index(name, ":-"); idx >= 0 {
+			name, def, has_def = name[:idx], name[idx+2:], true
+		}
+		if !matchEnvName.MatchString(name) {
+			if err == nil {
+				err = errors.New("Invalid environment variable " + item)
+			}
+			return item
+		}
+
+		value, ok := os.LookupEnv(name)
+		if has_def && len(value) == 0 {
+			return def
+		}
+		if !ok && err == nil {
+			err = errors.New("environment variable " + name + " is not set")
+		}
+		return value
+	})
+	return ret, err
+}
+
+// expandEnvValue expands environment variables in string scalars of a parsed yaml document, so
+// that variable values never change the document structure. MapSlice keeps the order of keys.
+// Expanded text stays a string, unless typ, the type the scalar is decoded into, is not a
+// string, then yaml decodes the text into typ. typ is nil if not known.
+func expandEnvValue(value interface{}, typ reflect.Type) (interface{}, error) {
+	var err error
+	switch item := value.(type) {
+	case string:
+		ret, err := expandEnv(item)
+		if err != nil || ret == item || typ == nil || typ.Kind() == reflect.String || typ.Kind() == reflect.Interface {
+			return ret, err
+		}
+		//plain values like port: ${PORT} are decoded as yaml does for the field
+		target := reflect.New(typ)
+		if err = yaml.Unmarshal([]byte(ret), target.Interface()); err != nil {
+			return nil, errors.New("Invalid value " + strconv.Quote(ret) + " of " + item + ": " + err.Error())
+		}
+		return target.Elem().Interface(), nil
+	case yaml.MapSlice:
+		for idx := range item {
+			key_type, value_type := mapEntryTypes(typ, item[idx].Key)
+			if item[idx].Key, err = expandEnvValue(item[idx].Key, key_type); err != nil {
+				return nil, err
+			}
+			if item[idx].Value, err = expandEnvValue(item[idx].Value, value_type); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		var elem_type reflect.Type
+		if typ = decodedType(typ); typ != nil && (typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array) {
+			elem_type = typ.Elem()
+		}
+		for idx := range item {
+			if item[idx], err = expandEnvValue(item[idx], elem_type); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return value, nil
+}
+
+var yamlUnmarshalerType reflect.Type = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// decodedType returns the type yaml decodes a value into, or nil if yaml does not decode it
+// by itself
+func decodedType(typ reflect.Type) reflect.Type {
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || reflect.PtrTo(typ).Implements(yamlUnmarshalerType) {
+		return nil
+	}
+	return typ
+}
+
+// mapEntryTypes returns types of the key and the value of a yaml mapping entry decoded into typ
+func mapEntryTypes(typ reflect.Type, key interface{}) (reflect.Type, reflect.Type) {
+	typ = decodedType(typ)
+	if typ == nil {
+		return nil, nil
+	}
+	switch typ.Kind() {
+	case reflect.Map:
+		return typ.Key(), typ.Elem()
+	case reflect.Struct:
+		name, _ := key.(string)
+		return nil, structFieldType(typ, name)
+	}
+	return nil, nil
+}
+
+// structFieldType finds the type of the field named in yaml tags, including inline fields
+func structFieldType(typ reflect.Type, name string) reflect.Type {
+	for idx := 0; idx < typ.NumField(); idx++ {
+		field := typ.Field(idx)
+		if len(field.PkgPath) > 0 {
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+		if len(tag) > 1 && tag[1] == "inline" {
+			if ret := structFieldType(field.Type, name); ret != nil {
+				return ret
+			}
+			continue
+		}
+		if tag[0] == name || (len(tag[0]) == 0 && strings.ToLower(field.Name) == name) {
+			return field.Type
+		}
+	}
+	return nil
+}
+
+// readConfFile reads a config file with environment variables expanded
+func readConfFile(conf_file string) (*Conf, error) {
+	conf_data, err := ioutil.ReadFile(conf_file)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := yaml.MapSlice{}
+	if err = yaml.Unmarshal(conf_data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", conf_file, err)
+	}
+	expanded, err := expandEnvValue(raw, reflect.TypeOf(Conf{}))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", conf_file, err)
+	}
+	data, err := yaml.Marshal(expanded)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", conf_file, err)
+	}
+
+	ret := &Conf{}
+	if err = yaml.Unmarshal(data, ret); err != nil {
+		return nil, fmt.Errorf("%s: %v", conf_file, err)
+	}
+	return ret, nil
+}
+
+// mergeIncludes merges upstreams and sites of included files into conf. Patterns are relative
+// to the directory of the main config file, and no name may be defined twice.
+func mergeIncludes(conf *Conf, conf_file string) error {
+	if len(conf.Include) == 0 {
+		return nil
+	}
+
+	upstream_files := make(map[string]string)
+	for key := range conf.Upstream {
+		upstream_files[upstreamName(key)] = conf_file
+	}
+	site_files := make(map[string]string)
+	for name := range conf.Sites {
+		site_files[name] = conf_file
+	}
+
+	if conf.Upstream == nil {
+		conf.Upstream = make(map[string][]string)
+	}
+	if conf.Sites == nil {
+		conf.Sites = make(map[string][]SiteConf)
+	}
+
+	errs := confErrors{}
+	for _, pattern := range conf.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(conf_file), pattern)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			errs.Add(errors.New("Invalid include pattern " + pattern))
+			continue
+		}
+		if len(files) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			errs.Add(errors.New("include file " + pattern + " does not exist"))
+			continue
+		}
+
+		for _, file := range files {
+			sub, err := readConfFile(file)
+			if err != nil {
+				errs.Add(err)
+				continue
+			}
+			if !reflect.DeepEqual(sub.Base, (Conf{}).Base) || len(sub.Include) > 0 {
+				errs.Add(errors.New(file + ": base and include are only allowed in main config file"))
+				continue
+			}
+
+			for key, entry_list := range sub.Upstream {
+				name := upstreamName(key)
+				if prev, ok := upstream_files[name]; ok {
+					errs.Add(fmt.Errorf("%s: upstream '%s' is already defined in %s", file, name, prev))
+					continue
+				}
+				upstream_files[name] = file
+				conf.Upstream[key] = entry_list
+			}
+			for name, site_list := range sub.Sites {
+				if prev, ok := site_files[name]; ok {
+					errs.Add(fmt.Errorf("%s: site '%s' is already defined in %s", file, name, prev))
+					continue
+				}
+				site_files[name] = file
+				conf.Sites[name] = site_list
+			}
+		}
+	}
+
+	return errs.Err()
+}
+
+func upstreamName(key string) string {
+	fields := strings.Fields(key)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
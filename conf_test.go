@@ -0,0 +1,194 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestRuleOrder(t *testing.T) {
+	raw := `
+rules:
+  - /:
+    - wwwroot /tmp
+    /api/:
+    - proxy http://127.0.0.1/
+    /api/v2/:
+    - proxy http://127.0.0.2/
+  - /static/:
+    - wwwroot /tmp/static
+`
+	site := SiteConf{}
+	if err := yaml.Unmarshal([]byte(raw), &site); err != nil {
+		t.Error(err)
+		return
+	}
+
+	check := func(rules RuleList, expect []string) {
+		if len(rules) != len(expect) {
+			t.Errorf("rule count not as expected: expected=%d actual=%d", len(expect), len(rules))
+			return
+		}
+		for idx, path := range expect {
+			if rules[idx].Key != path {
+				t.Errorf("rule #%d not as expected: expected=%s actual=%s", idx, path, rules[idx].Key)
+			}
+		}
+	}
+
+	check(site.Rules, []string{"/", "/api/", "/api/v2/", "/static/"})
+
+	if len(site.Rules[1].Actions) != 1 || site.Rules[1].Actions[0] != "proxy http://127.0.0.1/" {
+		t.Errorf("actions of /api/ not as expected: %v", site.Rules[1].Actions)
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("VERT_TEST_HOST", "www.example.com")
+	os.Setenv("VERT_TEST_EMPTY", "")
+	os.Unsetenv("VERT_TEST_UNSET")
+
+	cases := [][2]string{
+		{"${VERT_TEST_HOST}:", "www.example.com:"},
+		{"${VERT_TEST_UNSET:-8080}", "8080"},
+		{"${VERT_TEST_EMPTY:-default}", "default"},
+		{"~ ^/a$ $${VERT_TEST_HOST}", "~ ^/a$ ${VERT_TEST_HOST}"},
+	}
+	for _, item := range cases {
+		if ret, err := expandEnv(item[0]); err != nil || ret != item[1] {
+			t.Errorf("expand %s failed: expected=%s actual=%s err=%v", item[0], item[1], ret, err)
+		}
+	}
+
+	if _, err := expandEnv("${VERT_TEST_UNSET}"); err == nil {
+		t.Errorf("unset variable without default should fail")
+	}
+}
+
+func TestExpandEnvConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vert_env")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("VERT_TEST_EMAIL", "abc #def")
+	os.Setenv("VERT_TEST_HOST", "www.example.com")
+	os.Setenv("VERT_TEST_PORT", "8080")
+	os.Setenv("VERT_TEST_VALUE", "a: b\n*c [d]")
+	os.Setenv("VERT_TEST_TOKEN", "007123")
+	os.Setenv("VERT_TEST_SIGNED", "+15")
+	os.Setenv("VERT_TEST_BOOL", "true")
+	os.Unsetenv("VERT_TEST_UNSET")
+
+	conf_file := filepath.Join(dir, "conf.yaml")
+	ioutil.WriteFile(conf_file, []byte(`
+base:
+  tls_email: ${VERT_TEST_EMAIL}
+  # cert_cache: ${VERT_TEST_UNSET}
+  admin_token: "${VERT_TEST_TOKEN}"
+  cert_cache: ${VERT_TEST_SIGNED}
+sites:
+  ${VERT_TEST_HOST}:
+    - port: ${VERT_TEST_PORT}
+      type: http
+      listen: ${VERT_TEST_TOKEN}
+      proxy_protocol: ${VERT_TEST_BOOL}
+      rules:
+        - /b/:
+          - set-header X-Test ${VERT_TEST_VALUE}
+          /a/:
+          - wwwroot /tmp
+`), 0600)
+
+	conf, err := readConfFile(conf_file)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if conf.Base.TlsEmail != "abc #def" {
+		t.Errorf("tls_email not as expected: %q", conf.Base.TlsEmail)
+	}
+	if conf.Base.AdminToken != "007123" || conf.Base.CertCache != "+15" {
+		t.Errorf("string values should be kept as is: %q %q", conf.Base.AdminToken, conf.Base.CertCache)
+	}
+	sites := conf.Sites["www.example.com"]
+	if len(sites) != 1 || sites[0].Port != 8080 || sites[0].Listen != "007123" || !sites[0].ProxyProtocol {
+		t.Errorf("site not as expected: %v", conf.Sites)
+		return
+	}
+	rules := sites[0].Rules
+	if len(rules) != 2 || rules[0].Key != "/b/" || rules[1].Key != "/a/" {
+		t.Errorf("rules not as expected: %v", rules)
+		return
+	}
+	if len(rules[0].Actions) != 1 || rules[0].Actions[0] != "set-header X-Test a: b\n*c [d]" {
+		t.Errorf("actions not as expected: %q", rules[0].Actions)
+	}
+}
+
+func TestConfInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vert_conf")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name string, content string) {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+	}
+
+	write("secret/email", "admin@example.com\n")
+	write("conf.yaml", `
+include:
+  - sites.d/*.yaml
+base:
+  tls_email: file:`+filepath.Join(dir, "secret/email")+`
+upstream:
+  up_main:
+    - 127.0.0.1:8000
+sites:
+  www.a.com:
+    - port: 80
+`)
+	write("sites.d/b.yaml", `
+upstream:
+  up_b round_robin:
+    - 127.0.0.1:8001
+sites:
+  www.b.com:
+    - port: 80
+`)
+
+	conf, err := loadConf(filepath.Join(dir, "conf.yaml"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if conf.Base.TlsEmail != "admin@example.com" {
+		t.Errorf("tls_email not read from file: %s", conf.Base.TlsEmail)
+	}
+	if len(conf.Sites) != 2 || len(conf.Upstream) != 2 {
+		t.Errorf("included sites or upstreams not merged: sites=%d upstream=%d", len(conf.Sites), len(conf.Upstream))
+	}
+
+	write("sites.d/c.yaml", `
+upstream:
+  up_main least_conn:
+    - 127.0.0.1:8002
+sites:
+  www.b.com:
+    - port: 8080
+      type: http
+`)
+	_, err = loadConf(filepath.Join(dir, "conf.yaml"))
+	if errs, ok := err.(confErrors); !ok || len(errs) != 2 {
+		t.Errorf("duplicate upstream and site should both be reported: %v", err)
+	}
+}
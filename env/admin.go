@@ -0,0 +1,150 @@
+package env
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+)
+
+type EntryStatus struct {
+	Addr      string  `json:"addr"`
+	Weight    int     `json:"weight"`
+	Backup    bool    `json:"backup"`
+	Down      bool    `json:"down"`
+	Drained   bool    `json:"drained"`
+	Healthy   bool    `json:"healthy"`
+	Available bool    `json:"available"`
+	Inflight  int     `json:"inflight"`
+	MaxConns  int     `json:"max_conns"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+type GroupStatus struct {
+	Name     string        `json:"name"`
+	Strategy string        `json:"strategy"`
+	Entries  []EntryStatus `json:"entries"`
+}
+
+func (self *upstreamItem) status() EntryStatus {
+	return EntryStatus{
+		Addr:      self.addr,
+		Weight:    self.curWeight(),
+		Backup:    self.backup,
+		Down:      self.down,
+		Drained:   atomic.LoadInt32(&(self.drained)) == 1,
+		Healthy:   atomic.LoadInt32(&(self.healthy)) == 1,
+		Available: self.usable(),
+		Inflight:  int(atomic.LoadInt32(&(self.inflight))),
+		MaxConns:  int(self.max_conns),
+		LatencyMs: self.loadLatency() / 1e6,
+	}
+}
+
+// UpstreamStatus returns states of all running upstream groups sorted by name
+func UpstreamStatus() []GroupStatus {
+	gUpstreamLock.RLock()
+	groups := make([]*upstreamGroup, 0, len(gUpstreamMap))
+	for _, group := range gUpstreamMap {
+		groups = append(groups, group)
+	}
+	gUpstreamLock.RUnlock()
+	sort.Slice(groups, func(i, j int) bool { return groups[i].name < groups[j].name })
+
+	ret := make([]GroupStatus, 0, len(groups))
+	for _, group := range groups {
+		status := GroupStatus{Name: group.name, Entries: make([]EntryStatus, 0, len(group.entries))}
+		for name, strategy := range strategy2int {
+			if strategy == group.strategy {
+				status.Strategy = name
+			}
+		}
+		for _, item := range group.entries {
+			status.Entries = append(status.Entries, item.status())
+		}
+		ret = append(ret, status)
+	}
+	return ret
+}
+
+func findEntry(group string, addr string) (*upstreamGroup, *upstreamItem, error) {
+	gUpstreamLock.RLock()
+	curr, ok := gUpstreamMap[group]
+	gUpstreamLock.RUnlock()
+	if !ok {
+		return nil, nil, errors.New("upstream " + group + " not found")
+	}
+
+	for _, item := range curr.entries {
+		if item.addr == addr {
+			return curr, item, nil
+		}
+	}
+	return nil, nil, errors.New("entry " + addr + " not found in upstream " + group)
+}
+
+// DrainEntry stops sending new requests to an entry, requests in flight are not affected.
+// The entry is enabled again if drain is false.
+func DrainEntry(group string, addr string, drain bool) (EntryStatus, error) {
+	//entries replaced by DNS changes in between would lose the state
+	gUpstreamSwap.Lock()
+	defer gUpstreamSwap.Unlock()
+
+	curr, item, err := findEntry(group, addr)
+	if err != nil {
+		return EntryStatus{}, err
+	}
+	if curr.discovery != nil && !curr.discovery.isStatic(item) {
+		curr.discovery.setDrained(addr, drain)
+	}
+
+	value := int32(0)
+	if drain {
+		value = 1
+	}
+	atomic.StoreInt32(&(item.drained), value)
+	INFO_LOG("upstream %s entry %s drained=%v by admin", group, addr, drain)
+	return item.status(), nil
+}
+
+// SetEntryWeight changes weight of an entry in place, so its states and requests in flight are
+// kept. The group is rebuilt to take the weight into round robin and hash ring.
+func SetEntryWeight(group string, addr string, weight int) (EntryStatus, error) {
+	if weight < 1 {
+		return EntryStatus{}, errors.New("weight cannot be less than 1")
+	}
+
+	gUpstreamSwap.Lock()
+	defer gUpstreamSwap.Unlock()
+
+	curr, item, err := findEntry(group, addr)
+	if err != nil {
+		return EntryStatus{}, err
+	}
+
+	atomic.StoreInt32(&(item.weight), int32(weight))
+	if curr.discovery != nil && !curr.discovery.isStatic(item) {
+		curr.discovery.setWeight(addr, weight)
+	}
+
+	next := curr.clone()
+	next.entries = append(next.entries, curr.entries...)
+	next.sortEntries()
+	if next.strategy == us_client_hash || next.strategy == us_hash {
+		next.ring = newHashRing(next.entries)
+	}
+
+	replaceGroup(curr, next)
+	INFO_LOG("upstream %s entry %s weight=%d by admin", group, addr, weight)
+	return item.status(), nil
+}
+
+// replaceGroup swaps in a group rebuilt from curr, gUpstreamSwap should be held. The checker
+// of curr exits before the one of next starts, as they share entries.
+func replaceGroup(curr *upstreamGroup, next *upstreamGroup) {
+	curr.stopCheck()
+	next.startCheck()
+
+	gUpstreamLock.Lock()
+	gUpstreamMap[curr.name] = next
+	gUpstreamLock.Unlock()
+}
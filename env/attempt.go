@@ -0,0 +1,172 @@
+package env
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// BeginAttempt starts a new attempt of proxying req, entries picked by previous attempts are
+// avoided by later attempts as long as there are other available entries.
+func BeginAttempt(req *http.Request) {
+	if value := getCtxValue(req); value != nil {
+		value.releasePicks()
+		value.exhausted = false
+	}
+}
+
+// FinishRequest releases entries picked for req but never sent to, e.g. by a failed attempt or
+// an action other than proxy. It should be called when req is finished.
+func FinishRequest(req *http.Request) {
+	if value := getCtxValue(req); value != nil {
+		value.releasePicks()
+	}
+}
+
+func (self *ctxValue) releasePicks() {
+	for _, item := range self.picks {
+		item.item.release()
+	}
+	self.picks = nil
+}
+
+// NoUpstream tells whether an upstream group referenced by the current attempt had no entry
+// able to take the request, because all of them are disabled or reach max_conns.
+func NoUpstream(req *http.Request) bool {
+	if value := getCtxValue(req); value != nil {
+		return value.exhausted
+	}
+	return false
+}
+
+func recordExhausted(req *http.Request) {
+	if value := getCtxValue(req); value != nil {
+		value.exhausted = true
+	}
+}
+
+// Attempt is a request sent to the upstream entries picked since BeginAttempt
+type Attempt struct {
+	picks  []upstreamPick
+	start  time.Time
+	closed bool
+}
+
+// SendAttempt takes over entries picked by the current attempt, which are counted as in flight
+// since picked. Close of the returned attempt must be called when the request is finished.
+func SendAttempt(req *http.Request) *Attempt {
+	ret := &Attempt{start: time.Now()}
+	if value := getCtxValue(req); value != nil {
+		ret.picks = value.picks
+		value.picks = nil
+	}
+	return ret
+}
+
+// Done reports result of the attempt when the response header is received or the request fails.
+// A request fails if it gets no response or gets a 5xx response.
+func (self *Attempt) Done(failed bool) {
+	elapsed := time.Since(self.start)
+	for _, item := range self.picks {
+		item.group.report(item.item, failed)
+		if !failed {
+			item.item.updateLatency(elapsed)
+		}
+	}
+}
+
+// Cookies returns sticky session cookies which should be set on response of the attempt
+func (self *Attempt) Cookies() []*http.Cookie {
+	ret := make([]*http.Cookie, 0)
+	for _, item := range self.picks {
+		if item.cookie != nil {
+			ret = append(ret, item.cookie)
+		}
+	}
+	return ret
+}
+
+func (self *Attempt) Close() {
+	if self.closed {
+		return
+	}
+	self.closed = true
+	for _, item := range self.picks {
+		item.item.release()
+	}
+}
+
+// AttemptFailed tells whether the result of an attempt counts as a failure
+func AttemptFailed(rsp *http.Response, err error) bool {
+	return err != nil || rsp.StatusCode >= 500
+}
+
+// recordPick reserves a slot of item for req, it returns false if item reaches max_conns.
+// Requests without context value are not tracked.
+func recordPick(req *http.Request, group *upstreamGroup, item *upstreamItem, cookie *http.Cookie) bool {
+	value := getCtxValue(req)
+	if value == nil {
+		return true
+	}
+	if !item.reserve() {
+		return false
+	}
+
+	if value.tried == nil {
+		value.tried = make(map[*upstreamItem]bool)
+	}
+	value.tried[item] = true
+	value.picks = append(value.picks, upstreamPick{group: group, item: item, cookie: cookie})
+	return true
+}
+
+func triedEntries(req *http.Request) map[*upstreamItem]bool {
+	if value := getCtxValue(req); value != nil {
+		return value.tried
+	}
+	return nil
+}
+
+// candidates returns entries which may take a new request of req, in the order of preference:
+// primary entries, then backup entries, and entries ignoring health states if all are down. Entries
+// in slow start and entries tried by previous attempts are avoided if possible.
+func (self *upstreamGroup) candidates(req *http.Request) []*upstreamItem {
+	tried := triedEntries(req)
+	levels := []func(*upstreamItem) bool{
+		func(item *upstreamItem) bool { return !item.backup && item.usable() && !tried[item] && item.admitted() },
+		func(item *upstreamItem) bool { return !item.backup && item.usable() && !tried[item] },
+		func(item *upstreamItem) bool { return !item.backup && item.usable() },
+		func(item *upstreamItem) bool { return item.backup && item.usable() && !tried[item] },
+		func(item *upstreamItem) bool { return item.backup && item.usable() },
+		func(item *upstreamItem) bool { return !item.disabled() && !item.full() },
+	}
+
+	ret := make([]*upstreamItem, 0, len(self.entries))
+	for _, level := range levels {
+		for _, item := range self.entries {
+			if level(item) {
+				ret = append(ret, item)
+			}
+		}
+		if len(ret) > 0 {
+			break
+		}
+	}
+	return ret
+}
+
+// weightedRandom chooses an entry from items with probability in proportion to effective weight
+func weightedRandom(items []*upstreamItem) int {
+	total := 0.0
+	for _, item := range items {
+		total += item.effectiveWeight()
+	}
+	n := rand.Float64() * total
+	for idx, item := range items {
+		if n < item.effectiveWeight() {
+			return idx
+		}
+		n -= item.effectiveWeight()
+	}
+	return len(items) - 1
+}
@@ -0,0 +1,84 @@
+package env
+
+import (
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ewmaDecay is the weight of history in latency EWMA
+const ewmaDecay float64 = 0.8
+
+// updateLatency merges a response time into the EWMA of the entry
+func (self *upstreamItem) updateLatency(elapsed time.Duration) {
+	for {
+		old_bits := atomic.LoadUint64(&(self.latency))
+		old := math.Float64frombits(old_bits)
+		value := float64(elapsed)
+		if old > 0 {
+			value = old*ewmaDecay + value*(1-ewmaDecay)
+		}
+		if atomic.CompareAndSwapUint64(&(self.latency), old_bits, math.Float64bits(value)) {
+			return
+		}
+	}
+}
+
+func (self *upstreamItem) loadLatency() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&(self.latency)))
+}
+
+// getAddr_LeastConn chooses the entry with the fewest in flight requests per weight, ties are
+// broken in turn
+func (self *upstreamGroup) getAddr_LeastConn(req *http.Request) *upstreamItem {
+	candidates := self.candidates(req)
+	if len(candidates) == 0 {
+		return nil
+	}
+	start := int(atomic.AddUint32(&(self.curr_idx), 1) % uint32(len(candidates)))
+
+	var ret *upstreamItem
+	for i := 0; i < len(candidates); i++ {
+		item := candidates[(start+i)%len(candidates)]
+		if ret == nil {
+			ret = item
+			continue
+		}
+		if connCost(item) < connCost(ret) {
+			ret = item
+		}
+	}
+	return ret
+}
+
+// getAddr_LeastLatency chooses two entries randomly by weight, and uses the one with lower
+// cost, which is latency EWMA multiplied by in flight requests per weight
+func (self *upstreamGroup) getAddr_LeastLatency(req *http.Request) *upstreamItem {
+	candidates := self.candidates(req)
+	if len(candidates) <= 1 {
+		if len(candidates) == 0 {
+			return nil
+		}
+		return candidates[0]
+	}
+
+	first := weightedRandom(candidates)
+	rest := append(append([]*upstreamItem{}, candidates[:first]...), candidates[first+1:]...)
+	a, b := candidates[first], rest[weightedRandom(rest)]
+
+	if latencyCost(b) < latencyCost(a) {
+		return b
+	}
+	return a
+}
+
+func connCost(item *upstreamItem) float64 {
+	return float64(atomic.LoadInt32(&(item.inflight))) / item.effectiveWeight()
+}
+
+func latencyCost(item *upstreamItem) float64 {
+	//entries without latency samples are preferred so that they get measured
+	latency := item.loadLatency()
+	return latency * float64(atomic.LoadInt32(&(item.inflight))+1) / item.effectiveWeight()
+}
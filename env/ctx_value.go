@@ -6,22 +6,41 @@ import (
 
 type ctxValue struct {
 	host string
+
+	picks []upstreamPick         // upstream entries picked by the current attempt
+	tried map[*upstreamItem]bool // upstream entries picked by all attempts
+
+	exhausted bool // an upstream group of the current attempt had no entry to use
 }
 
-func Host(req *http.Request) string {
+type upstreamPick struct {
+	group  *upstreamGroup
+	item   *upstreamItem
+	cookie *http.Cookie // sticky session cookie to set, nil if not needed
+}
+
+func getCtxValue(req *http.Request) *ctxValue {
+	if req == nil {
+		return nil
+	}
+
 	ctx := req.Context()
 	if ctx == nil {
-		return ""
+		return nil
 	}
 
 	value := ctx.Value(VERT_CONTEXT_KEY)
 	if value == nil {
-		return ""
+		return nil
 	}
 
-	if ret, ok := value.(*ctxValue); ok {
-		return ret.host
-	}
+	ret, _ := value.(*ctxValue)
+	return ret
+}
 
+func Host(req *http.Request) string {
+	if value := getCtxValue(req); value != nil {
+		return value.host
+	}
 	return ""
 }
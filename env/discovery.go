@@ -0,0 +1,360 @@
+package env
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultDnsRefresh time.Duration = time.Second * 30
+const dnsTimeout time.Duration = time.Second * 5
+
+// Resolver looks up DNS records of upstream entries, net.DefaultResolver is used by default
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+type resolverHolder struct{ Resolver }
+
+var gResolver atomic.Value // resolverHolder
+
+func SetResolver(resolver Resolver) { gResolver.Store(resolverHolder{resolver}) }
+
+func curResolver() Resolver {
+	if ret, ok := gResolver.Load().(resolverHolder); ok {
+		return ret.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// gUpstreamSwap serializes replacing groups in gUpstreamMap by config reloads and by DNS changes
+var gUpstreamSwap sync.Mutex
+
+// dnsRecord is an entry resolved from DNS:
+//
+//	dns+HOST:PORT [refresh=30s] [options...]   each A/AAAA record becomes an entry
+//	srv+_SERVICE._PROTO.NAME [refresh=30s] [options...]   each SRV record becomes an entry, SRV
+//	                                                       weight is used as weight, and records
+//	                                                       of lower priority are backup entries
+type dnsRecord struct {
+	srv     bool
+	name    string
+	port    string // for dns+ only
+	refresh time.Duration
+	options []string // options of each resolved entry
+
+	resolved []resolvedAddr // result of the last successful lookup
+	next_at  time.Time
+}
+
+type resolvedAddr struct {
+	addr   string
+	weight int // 0 for not set
+	backup bool
+}
+
+func (self *dnsRecord) key() string {
+	return strconv.FormatBool(self.srv) + "|" + self.name + "|" + self.port + "|" + strings.Join(self.options, " ")
+}
+
+// discovery keeps entries of a group resolved from DNS up to date in background
+type discovery struct {
+	lock    sync.Mutex
+	static  []*upstreamItem
+	records []*dnsRecord
+	ch_stop chan struct{}
+	ch_done chan struct{} // closed when the background lookup exits
+
+	//changes made by admin to resolved entries, keyed by address, so they survive DNS changes
+	weights map[string]int
+	drained map[string]bool
+}
+
+func isDnsEntry(addr string) bool {
+	return strings.HasPrefix(addr, "dns+") || strings.HasPrefix(addr, "srv+")
+}
+
+func parseDnsRecord(fields []string) (*dnsRecord, error) {
+	ret := &dnsRecord{srv: strings.HasPrefix(fields[0], "srv+"), name: fields[0][4:], refresh: defaultDnsRefresh}
+
+	if !ret.srv {
+		host, port, err := net.SplitHostPort(ret.name)
+		if err != nil {
+			return nil, err
+		}
+		ret.name, ret.port = host, port
+	}
+	if len(ret.name) == 0 {
+		return nil, errors.New("empty name in " + fields[0])
+	}
+
+	for _, option := range fields[1:] {
+		if strings.HasPrefix(option, "refresh=") {
+			refresh, err := time.ParseDuration(option[len("refresh="):])
+			if err != nil || refresh <= 0 {
+				return nil, errors.New("Invalid " + option)
+			}
+			ret.refresh = refresh
+			continue
+		}
+		if ret.srv && strings.HasPrefix(option, "weight=") {
+			return nil, errors.New("weight of srv+ entries comes from SRV records")
+		}
+		ret.options = append(ret.options, option)
+	}
+
+	//validate entry options
+	if err := (&upstreamItem{}).parseOptions(ret.options); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// resolve looks up the record, and tells whether the result is changed. The last result is
+// kept if lookup fails.
+func (self *dnsRecord) resolve(group string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+
+	result := make([]resolvedAddr, 0)
+	if self.srv {
+		_, records, err := curResolver().LookupSRV(ctx, "", "", self.name)
+		if err != nil || len(records) == 0 {
+			ERROR_LOG("upstream %s lookup SRV %s failed: %v", group, self.name, err)
+			return false
+		}
+		min_priority := records[0].Priority
+		for _, item := range records {
+			if item.Priority < min_priority {
+				min_priority = item.Priority
+			}
+		}
+		for _, item := range records {
+			weight := int(item.Weight)
+			if weight < 1 {
+				weight = 1
+			}
+			result = append(result, resolvedAddr{
+				addr:   net.JoinHostPort(strings.TrimSuffix(item.Target, "."), strconv.Itoa(int(item.Port))),
+				weight: weight,
+				backup: item.Priority > min_priority,
+			})
+		}
+	} else {
+		addrs, err := curResolver().LookupIPAddr(ctx, self.name)
+		if err != nil || len(addrs) == 0 {
+			ERROR_LOG("upstream %s lookup %s failed: %v", group, self.name, err)
+			return false
+		}
+		for _, item := range addrs {
+			result = append(result, resolvedAddr{addr: net.JoinHostPort(item.IP.String(), self.port)})
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].addr < result[j].addr })
+	if len(result) == len(self.resolved) {
+		changed := false
+		for idx := range result {
+			changed = changed || result[idx] != self.resolved[idx]
+		}
+		if !changed {
+			return false
+		}
+	}
+
+	INFO_LOG("upstream %s %s resolved to %d entries", group, self.name, len(result))
+	self.resolved = result
+	return true
+}
+
+// resolveAll looks up records due for refresh, and returns the time of next refresh
+func (self *discovery) resolveAll(group string, force bool) (bool, time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := time.Now()
+	next := now.Add(time.Hour)
+	changed := false
+	for _, record := range self.records {
+		if force || !now.Before(record.next_at) {
+			changed = record.resolve(group) || changed
+			record.next_at = now.Add(record.refresh)
+		}
+		if record.next_at.Before(next) {
+			next = record.next_at
+		}
+	}
+	return changed, next
+}
+
+// inherit takes last results of the same records from a replaced discovery
+func (self *discovery) inherit(prev *discovery) {
+	prev.lock.Lock()
+	results := make(map[string][]resolvedAddr)
+	for _, record := range prev.records {
+		results[record.key()] = record.resolved
+	}
+	prev.lock.Unlock()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, record := range self.records {
+		record.resolved = results[record.key()]
+	}
+}
+
+func (self *discovery) start(group string, next time.Time) {
+	if self.ch_stop != nil {
+		return
+	}
+	self.ch_stop = make(chan struct{})
+	self.ch_done = make(chan struct{})
+	go self.run(group, next, self.ch_stop, self.ch_done)
+}
+
+// stop stops the background lookup and waits for it to exit, see stopDiscovery
+func (self *discovery) stop() {
+	if self.ch_stop != nil {
+		close(self.ch_stop)
+		<-self.ch_done
+		self.ch_stop, self.ch_done = nil, nil
+	}
+}
+
+func (self *discovery) run(group string, next time.Time, ch_stop chan struct{}, ch_done chan struct{}) {
+	defer close(ch_done)
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ch_stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		var changed bool
+		changed, next = self.resolveAll(group, false)
+		if changed {
+			self.swap(group)
+		}
+	}
+}
+
+// swap replaces the running group with one built from the latest DNS results
+func (self *discovery) swap(name string) {
+	gUpstreamSwap.Lock()
+	defer gUpstreamSwap.Unlock()
+
+	gUpstreamLock.RLock()
+	curr := gUpstreamMap[name]
+	gUpstreamLock.RUnlock()
+
+	//the group has been replaced by config reload
+	if curr == nil || curr.discovery != self {
+		return
+	}
+
+	replaceGroup(curr, curr.rebuild())
+}
+
+// isStatic tells whether the entry has a fixed address
+func (self *discovery) isStatic(item *upstreamItem) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, entry := range self.static {
+		if entry == item {
+			return true
+		}
+	}
+	return false
+}
+
+// setWeight keeps the weight of a resolved entry set by admin
+func (self *discovery) setWeight(addr string, weight int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.weights == nil {
+		self.weights = make(map[string]int)
+	}
+	self.weights[addr] = weight
+}
+
+// setDrained keeps the drain state of a resolved entry set by admin
+func (self *discovery) setDrained(addr string, drain bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.drained == nil {
+		self.drained = make(map[string]bool)
+	}
+	self.drained[addr] = drain
+}
+
+// rebuild creates a group with the same config and the latest DNS results. Entries which are
+// still there are shared with the new group, so their states are kept. Changes made by admin
+// are applied to resolved entries.
+func (self *upstreamGroup) rebuild() *upstreamGroup {
+	ret := self.clone()
+
+	items := make(map[string]*upstreamItem)
+	for _, item := range self.entries {
+		items[item.key()] = item
+	}
+
+	self.discovery.lock.Lock()
+	ret.entries = append(ret.entries, self.discovery.static...)
+	for _, record := range self.discovery.records {
+		for _, resolved := range record.resolved {
+			item := &upstreamItem{addr: resolved.addr, weight: 1, healthy: 1}
+			item.parseOptions(record.options)
+			if resolved.weight > 0 {
+				item.weight = int32(resolved.weight)
+			}
+			item.backup = item.backup || resolved.backup
+			if weight, ok := self.discovery.weights[item.addr]; ok {
+				item.weight = int32(weight)
+			}
+
+			if prev, ok := items[item.key()]; ok {
+				item = prev
+			} else if self.discovery.drained[item.addr] {
+				item.drained = 1
+			}
+			ret.entries = append(ret.entries, item)
+		}
+	}
+	self.discovery.lock.Unlock()
+
+	ret.sortEntries()
+	if ret.strategy == us_client_hash || ret.strategy == us_hash {
+		ret.ring = newHashRing(ret.entries)
+	}
+	return ret
+}
+
+// clone copies config of the group without entries
+func (self *upstreamGroup) clone() *upstreamGroup {
+	return &upstreamGroup{
+		name:      self.name,
+		strategy:  self.strategy,
+		check:     self.check,
+		passive:   self.passive,
+		hash_key:  self.hash_key,
+		sticky:    self.sticky,
+		discovery: self.discovery,
+
+		proxy_protocol: self.proxy_protocol,
+	}
+}
+
+// key identifies entries with the same address and options
+func (self *upstreamItem) key() string {
+	return self.addr + "|" + strconv.Itoa(self.curWeight()) + "|" + strconv.FormatBool(self.backup) + "|" +
+		strconv.FormatBool(self.down) + "|" + strconv.Itoa(int(self.max_conns)) + "|" + self.slow_start.String()
+}
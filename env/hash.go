@@ -0,0 +1,138 @@
+package env
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ketamaPoints is the number of points on hash ring for each weight unit of an entry
+const ketamaPoints int = 160
+
+type ringPoint struct {
+	hash uint32
+	item *upstreamItem
+}
+
+// hashRing is a ketama consistent hash ring, adding or removing an entry only moves keys
+// of that entry
+type hashRing []ringPoint
+
+// ketamaMaxWeight limits size of hash ring, larger weights like those from SRV records are scaled down
+const ketamaMaxWeight int = 100
+
+func newHashRing(entries []*upstreamItem) hashRing {
+	max_weight := 0
+	for _, item := range entries {
+		if item.curWeight() > max_weight {
+			max_weight = item.curWeight()
+		}
+	}
+
+	ret := make(hashRing, 0)
+	for _, item := range entries {
+		weight := item.curWeight()
+		if max_weight > ketamaMaxWeight {
+			weight = weight * ketamaMaxWeight / max_weight
+			if weight < 1 {
+				weight = 1
+			}
+		}
+		for i := 0; i < weight*ketamaPoints/4; i++ {
+			digest := md5.Sum([]byte(item.addr + "-" + strconv.Itoa(i)))
+			for j := 0; j < 4; j++ {
+				ret = append(ret, ringPoint{hash: binary.LittleEndian.Uint32(digest[j*4:]), item: item})
+			}
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].hash < ret[j].hash })
+	return ret
+}
+
+func hashKey(key string) uint32 {
+	digest := md5.Sum([]byte(key))
+	return binary.LittleEndian.Uint32(digest[:4])
+}
+
+// lookup returns the first entry in usable clockwise from hash of key, nil if usable is empty
+func (self hashRing) lookup(key string, usable map[*upstreamItem]bool) *upstreamItem {
+	hash := hashKey(key)
+	start := sort.Search(len(self), func(i int) bool { return self[i].hash >= hash })
+	for i := 0; i < len(self); i++ {
+		point := self[(start+i)%len(self)]
+		if usable[point.item] {
+			return point.item
+		}
+	}
+	return nil
+}
+
+// KeyCompiler compiles a Vert variable expression like "{query:user_id}" into a function
+// evaluating it on requests. It is set by the action package.
+type KeyCompiler func(expr string) (func(*http.Request) string, error)
+
+var gKeyCompiler KeyCompiler
+
+func SetKeyCompiler(compiler KeyCompiler) { gKeyCompiler = compiler }
+
+// parseHashKey parses hash_key option:
+//
+//	client_ip  header:NAME  cookie:NAME  query:NAME  or a Vert variable expression
+func parseHashKey(key string) (func(*http.Request) string, error) {
+	switch {
+	case key == "client_ip":
+		return clientIP, nil
+	case strings.HasPrefix(key, "header:") && len(key) > len("header:"):
+		name := key[len("header:"):]
+		return func(req *http.Request) string { return req.Header.Get(name) }, nil
+	case strings.HasPrefix(key, "cookie:") && len(key) > len("cookie:"):
+		name := key[len("cookie:"):]
+		return func(req *http.Request) string {
+			if cookie, err := req.Cookie(name); err == nil {
+				return cookie.Value
+			}
+			return ""
+		}, nil
+	case strings.HasPrefix(key, "query:") && len(key) > len("query:"):
+		name := key[len("query:"):]
+		return func(req *http.Request) string { return req.URL.Query().Get(name) }, nil
+	case strings.Contains(key, "{"):
+		if gKeyCompiler == nil {
+			return nil, errors.New("variable expression is not supported in hash_key")
+		}
+		return gKeyCompiler(key)
+	}
+	return nil, errors.New("Invalid hash_key " + key)
+}
+
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// getAddr_Hash chooses entry by hash key of req on the consistent hash ring, requests whose
+// hash key is empty are hashed by client IP
+func (self *upstreamGroup) getAddr_Hash(req *http.Request) *upstreamItem {
+	if req == nil {
+		return self.pick(0, nil)
+	}
+
+	key := self.hash_key(req)
+	if len(key) == 0 {
+		key = clientIP(req)
+	}
+
+	usable := make(map[*upstreamItem]bool)
+	for _, item := range self.candidates(req) {
+		usable[item] = true
+	}
+	return self.ring.lookup(key, usable)
+}
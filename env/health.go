@@ -0,0 +1,292 @@
+package env
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const check_tcp int = 1
+const check_http int = 2
+const check_https int = 3
+
+const defaultCheckInterval time.Duration = time.Second * 5
+const defaultCheckTimeout time.Duration = time.Second * 2
+const defaultCheckRise int = 2
+const defaultCheckFall int = 3
+
+// healthCheck is the active health check config of an upstream group:
+//
+//	check=http|https|tcp  check_path=/healthz  check_host=example.com  check_status=200,3xx
+//	check_interval=5s  check_timeout=2s  rise=2  fall=3
+type healthCheck struct {
+	kind     int
+	path     string
+	host     string
+	statuses []string // status codes, or classes like "2xx"
+	interval time.Duration
+	timeout  time.Duration
+	rise     int
+	fall     int
+
+	client *http.Client
+
+	proxy_protocol int // PROXY protocol version of the group, probes send headers without addresses
+}
+
+// parseHealthCheck takes health check options out of options, returns nil if check is not set
+func parseHealthCheck(options map[string]string) (*healthCheck, error) {
+	kind_str, ok := options["check"]
+	if !ok {
+		for _, key := range []string{"check_path", "check_host", "check_status", "check_interval", "check_timeout", "rise", "fall"} {
+			if _, ok := options[key]; ok {
+				return nil, errors.New(key + " requires check option")
+			}
+		}
+		return nil, nil
+	}
+	delete(options, "check")
+
+	ret := &healthCheck{
+		path:     "/",
+		statuses: []string{"2xx", "3xx"},
+		interval: defaultCheckInterval,
+		timeout:  defaultCheckTimeout,
+		rise:     defaultCheckRise,
+		fall:     defaultCheckFall,
+	}
+
+	switch kind_str {
+	case "tcp":
+		ret.kind = check_tcp
+	case "http":
+		ret.kind = check_http
+	case "https":
+		ret.kind = check_https
+	default:
+		return nil, errors.New("Invalid check type " + kind_str)
+	}
+
+	var err error
+	for key, value := range options {
+		switch key {
+		case "check_path":
+			if !strings.HasPrefix(value, "/") {
+				return nil, errors.New("check_path should start with '/'")
+			}
+			ret.path = value
+		case "check_host":
+			ret.host = value
+		case "check_status":
+			ret.statuses = strings.Split(value, ",")
+			for _, status := range ret.statuses {
+				if len(status) != 3 || (!strings.HasSuffix(status, "xx") && !isDigits(status)) {
+					return nil, errors.New("Invalid check_status " + value)
+				}
+			}
+		case "check_interval":
+			ret.interval, err = time.ParseDuration(value)
+			if err == nil && ret.interval <= 0 {
+				err = errors.New("check_interval should be positive")
+			}
+		case "check_timeout":
+			ret.timeout, err = time.ParseDuration(value)
+			if err == nil && ret.timeout <= 0 {
+				err = errors.New("check_timeout should be positive")
+			}
+		case "rise":
+			ret.rise, err = positiveInt(key, value)
+		case "fall":
+			ret.fall, err = positiveInt(key, value)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		delete(options, key)
+	}
+
+	if ret.kind == check_tcp && ret.path != "/" {
+		return nil, errors.New("check_path is not available for tcp check")
+	}
+
+	ret.client = &http.Client{
+		Timeout: ret.timeout,
+		Transport: &http.Transport{
+			DialContext:       ret.dial,
+			DisableKeepAlives: true,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return ret, nil
+}
+
+func isDigits(value string) bool {
+	for idx := 0; idx < len(value); idx++ {
+		if value[idx] < '0' || value[idx] > '9' {
+			return false
+		}
+	}
+	return len(value) > 0
+}
+
+func positiveInt(key string, value string) (int, error) {
+	ret, err := strconv.Atoi(value)
+	if err != nil || ret < 1 {
+		return 0, errors.New("Invalid " + key + " " + value)
+	}
+	return ret, nil
+}
+
+func (self *healthCheck) dial(ctx context.Context, network string, addr string) (net.Conn, error) {
+	if self.proxy_protocol != 0 {
+		ctx = WithProxyHeader(ctx, proxyHeader(self.proxy_protocol, nil, nil))
+	}
+	return ProxyProtocolDialer(&net.Dialer{})(ctx, network, addr)
+}
+
+// probe checks an address once
+func (self *healthCheck) probe(ctx context.Context, addr string) error {
+	if self.kind == check_tcp {
+		ctx, cancel := context.WithTimeout(ctx, self.timeout)
+		defer cancel()
+		conn, err := self.dial(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	scheme := "http://"
+	if self.kind == check_https {
+		scheme = "https://"
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", scheme+addr+self.path, nil)
+	if err != nil {
+		return err
+	}
+	if len(self.host) > 0 {
+		req.Host = self.host
+	}
+	req.Header.Set("User-Agent", "Vert-HealthCheck")
+
+	rsp, err := self.client.Do(req)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+
+	code := strconv.Itoa(rsp.StatusCode)
+	for _, status := range self.statuses {
+		if status == code || (strings.HasSuffix(status, "xx") && status[0] == code[0]) {
+			return nil
+		}
+	}
+	return errors.New("unexpected status " + code)
+}
+
+func (self *upstreamGroup) startCheck() {
+	if self.check == nil || self.ch_stop != nil {
+		return
+	}
+	self.ch_stop = make(chan struct{})
+	self.ch_done = make(chan struct{})
+	go self.runCheck(self.ch_stop, self.ch_done)
+}
+
+// stopCheck stops the checker and waits for it to exit, since entries may be shared with the
+// group replacing this one, whose checker updates the same check results
+func (self *upstreamGroup) stopCheck() {
+	if self.ch_stop != nil {
+		close(self.ch_stop)
+		<-self.ch_done
+		self.ch_stop, self.ch_done = nil, nil
+	}
+}
+
+func (self *upstreamGroup) runCheck(ch_stop chan struct{}, ch_done chan struct{}) {
+	defer close(ch_done)
+	ticker := time.NewTicker(self.check.interval)
+	defer ticker.Stop()
+
+	//probes in progress are canceled on stop
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-ch_stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		wg := sync.WaitGroup{}
+		for _, item := range self.entries {
+			if item.down {
+				continue
+			}
+			wg.Add(1)
+			go func(item *upstreamItem) {
+				defer wg.Done()
+				err := self.check.probe(ctx, item.addr)
+				if ctx.Err() == nil {
+					self.updateHealth(item, err)
+				}
+			}(item)
+		}
+		wg.Wait()
+
+		select {
+		case <-ch_stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (self *upstreamGroup) updateHealth(item *upstreamItem, err error) {
+	if err != nil {
+		item.check_success = 0
+		item.check_failure++
+		if item.check_failure >= self.check.fall && atomic.CompareAndSwapInt32(&(item.healthy), 1, 0) {
+			ERROR_LOG("upstream %s entry %s is down: %v", self.name, item.addr, err)
+		}
+		return
+	}
+
+	item.check_failure = 0
+	item.check_success++
+	if item.check_success >= self.check.rise && atomic.CompareAndSwapInt32(&(item.healthy), 0, 1) {
+		atomic.StoreInt64(&(item.recover_at), time.Now().UnixNano())
+		INFO_LOG("upstream %s entry %s is up", self.name, item.addr)
+	}
+}
+
+// inheritHealth copies health states of entries with the same address from a replaced group
+func (self *upstreamGroup) inheritHealth(prev *upstreamGroup) {
+	if self.check == nil || prev.check == nil {
+		return
+	}
+	states := make(map[string]*upstreamItem)
+	for _, item := range prev.entries {
+		states[item.addr] = item
+	}
+	for _, item := range self.entries {
+		if state, ok := states[item.addr]; ok {
+			item.healthy = atomic.LoadInt32(&(state.healthy))
+			item.recover_at = atomic.LoadInt64(&(state.recover_at))
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package env
+
+type Logger interface {
+	DEBUG_LOG(string, []interface{})
+	INFO_LOG(string, []interface{})
+	ERROR_LOG(string, []interface{})
+}
+
+type nopLogger struct{}
+
+func (self nopLogger) DEBUG_LOG(fmt string, args []interface{}) {}
+func (self nopLogger) INFO_LOG(fmt string, args []interface{})  {}
+func (self nopLogger) ERROR_LOG(fmt string, args []interface{}) {}
+
+var logger Logger = nopLogger{}
+
+func SetLogger(l Logger) { logger = l }
+
+func DEBUG_LOG(fmt string, args ...interface{}) { logger.DEBUG_LOG(fmt, args) }
+func INFO_LOG(fmt string, args ...interface{})  { logger.INFO_LOG(fmt, args) }
+func ERROR_LOG(fmt string, args ...interface{}) { logger.ERROR_LOG(fmt, args) }
@@ -0,0 +1,63 @@
+package env
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const defaultFailTimeout time.Duration = time.Second * 10
+
+// passiveCheck marks an entry down for fail_timeout after max_fails consecutive failed requests
+type passiveCheck struct {
+	max_fails    int32
+	fail_timeout time.Duration
+}
+
+// parsePassiveCheck takes max_fails and fail_timeout out of options, returns nil if max_fails is not set
+func parsePassiveCheck(options map[string]string) (*passiveCheck, error) {
+	max_fails, ok := options["max_fails"]
+	if !ok {
+		if _, ok := options["fail_timeout"]; ok {
+			return nil, errors.New("fail_timeout requires max_fails option")
+		}
+		return nil, nil
+	}
+	delete(options, "max_fails")
+
+	ret := &passiveCheck{fail_timeout: defaultFailTimeout}
+	n, err := positiveInt("max_fails", max_fails)
+	if err != nil {
+		return nil, err
+	}
+	ret.max_fails = int32(n)
+
+	if value, ok := options["fail_timeout"]; ok {
+		delete(options, "fail_timeout")
+		if ret.fail_timeout, err = time.ParseDuration(value); err != nil || ret.fail_timeout <= 0 {
+			return nil, errors.New("Invalid fail_timeout " + value)
+		}
+	}
+	return ret, nil
+}
+
+func (self *upstreamGroup) report(item *upstreamItem, failed bool) {
+	if self.passive == nil {
+		return
+	}
+
+	if !failed {
+		atomic.StoreInt32(&(item.fails), 0)
+		return
+	}
+
+	if atomic.AddInt32(&(item.fails), 1) < self.passive.max_fails {
+		return
+	}
+	atomic.StoreInt32(&(item.fails), 0)
+	down_until := time.Now().Add(self.passive.fail_timeout).UnixNano()
+	atomic.StoreInt64(&(item.down_until), down_until)
+	atomic.StoreInt64(&(item.recover_at), down_until)
+	ERROR_LOG("upstream %s entry %s failed %d times in a row, marked down for %v",
+		self.name, item.addr, self.passive.max_fails, self.passive.fail_timeout)
+}
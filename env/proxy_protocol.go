@@ -0,0 +1,132 @@
+package env
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+const proxy_v1 int = 1
+const proxy_v2 int = 2
+
+// ProxyV2Signature starts every PROXY protocol v2 header
+var ProxyV2Signature []byte = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+type proxyHeaderKey struct{}
+
+// parseProxyProtocol takes proxy_protocol=v1|v2 out of options, returns 0 if it is not set
+func parseProxyProtocol(options map[string]string) (int, error) {
+	value, ok := options["proxy_protocol"]
+	if !ok {
+		return 0, nil
+	}
+	delete(options, "proxy_protocol")
+
+	switch value {
+	case "v1":
+		return proxy_v1, nil
+	case "v2":
+		return proxy_v2, nil
+	}
+	return 0, errors.New("Invalid proxy_protocol " + value)
+}
+
+// ProxyHeader returns the PROXY protocol header to send to upstream entries picked by the
+// current attempt of req, nil if their groups do not require it
+func ProxyHeader(req *http.Request) []byte {
+	value := getCtxValue(req)
+	if value == nil {
+		return nil
+	}
+
+	for _, pick := range value.picks {
+		if pick.group.proxy_protocol == 0 {
+			continue
+		}
+		local, _ := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		return proxyHeader(pick.group.proxy_protocol, addrOf(req.RemoteAddr), local)
+	}
+	return nil
+}
+
+func addrOf(addr string) *net.TCPAddr {
+	ret, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil || ret.IP == nil {
+		return nil
+	}
+	return ret
+}
+
+// proxyHeader builds a PROXY protocol header from src to dst, a header without addresses is
+// built if any of them is not a TCP address, e.g. for health checks and unix socket clients
+func proxyHeader(version int, src *net.TCPAddr, dst net.Addr) []byte {
+	dst_tcp, _ := dst.(*net.TCPAddr)
+	if src != nil && dst_tcp != nil && (src.IP.To4() == nil) != (dst_tcp.IP.To4() == nil) {
+		//client and local addresses are of different families, local one is converted if possible
+		if ip := dst_tcp.IP.To4(); ip != nil {
+			dst_tcp = &net.TCPAddr{IP: ip.To16(), Port: dst_tcp.Port}
+		} else {
+			dst_tcp = nil
+		}
+	}
+
+	if version == proxy_v1 {
+		if src == nil || dst_tcp == nil {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		proto, dst_ip := "TCP6", dst_tcp.IP.String()
+		if src.IP.To4() != nil {
+			proto = "TCP4"
+		} else if dst_tcp.IP.To4() != nil {
+			dst_ip = "::ffff:" + dst_ip
+		}
+		return []byte("PROXY " + proto + " " + src.IP.String() + " " + dst_ip + " " +
+			strconv.Itoa(src.Port) + " " + strconv.Itoa(dst_tcp.Port) + "\r\n")
+	}
+
+	ret := append([]byte{}, ProxyV2Signature...)
+	if src == nil || dst_tcp == nil {
+		//LOCAL command, the receiver uses real connection addresses
+		return append(ret, 0x20, 0x00, 0x00, 0x00)
+	}
+
+	src_ip, dst_ip, family := src.IP.To4(), dst_tcp.IP.To4(), byte(0x11)
+	if src_ip == nil {
+		src_ip, dst_ip, family = src.IP.To16(), dst_tcp.IP.To16(), 0x21
+	}
+	body := append(append([]byte{}, src_ip...), dst_ip...)
+	body = append(body, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(body[len(body)-4:], uint16(src.Port))
+	binary.BigEndian.PutUint16(body[len(body)-2:], uint16(dst_tcp.Port))
+
+	ret = append(ret, 0x21, family, 0, 0)
+	binary.BigEndian.PutUint16(ret[len(ret)-2:], uint16(len(body)))
+	return append(ret, body...)
+}
+
+// WithProxyHeader makes ProxyProtocolDialer send header on connections dialed with ctx
+func WithProxyHeader(ctx context.Context, header []byte) context.Context {
+	return context.WithValue(ctx, proxyHeaderKey{}, header)
+}
+
+// ProxyProtocolDialer returns a dial function sending the PROXY protocol header carried by ctx.
+// Connections sending headers describe a single client, so they should never be reused by other requests.
+func ProxyProtocolDialer(dialer *net.Dialer) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if header, ok := ctx.Value(proxyHeaderKey{}).([]byte); ok && len(header) > 0 {
+			if _, err := conn.Write(header); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return conn, nil
+	}
+}
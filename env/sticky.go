@@ -0,0 +1,130 @@
+package env
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// stickySession routes requests carrying the cookie to the entry named by it:
+//
+//	sticky=COOKIE_NAME  sticky_ttl=1h
+type stickySession struct {
+	cookie string
+	ttl    time.Duration // 0 for session cookies
+}
+
+var gStickySecret atomic.Value // []byte
+var gDefaultStickySecret []byte
+
+func init() {
+	gDefaultStickySecret = make([]byte, 32)
+	rand.Read(gDefaultStickySecret)
+	gStickySecret.Store(gDefaultStickySecret)
+}
+
+// SetStickySecret sets the key signing sticky cookies. A random key generated at startup is used
+// if secret is empty, so cookies are not valid after restart.
+func SetStickySecret(secret string) {
+	if len(secret) == 0 {
+		gStickySecret.Store(gDefaultStickySecret)
+		return
+	}
+	gStickySecret.Store([]byte(secret))
+}
+
+// parseSticky takes sticky and sticky_ttl out of options, returns nil if sticky is not set
+func parseSticky(options map[string]string) (*stickySession, error) {
+	name, ok := options["sticky"]
+	if !ok {
+		if _, ok := options["sticky_ttl"]; ok {
+			return nil, errors.New("sticky_ttl requires sticky option")
+		}
+		return nil, nil
+	}
+	delete(options, "sticky")
+
+	if len(name) == 0 || strings.ContainsAny(name, "=;, \t") {
+		return nil, errors.New("Invalid sticky cookie name " + name)
+	}
+	ret := &stickySession{cookie: name}
+
+	if value, ok := options["sticky_ttl"]; ok {
+		delete(options, "sticky_ttl")
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return nil, errors.New("Invalid sticky_ttl " + value)
+		}
+		ret.ttl = ttl
+	}
+	return ret, nil
+}
+
+// stickyID identifies an entry in cookie without exposing its address
+func stickyID(item *upstreamItem) string {
+	digest := md5.Sum([]byte(item.addr))
+	return hex.EncodeToString(digest[:6])
+}
+
+func (self *upstreamGroup) stickySign(id string) string {
+	mac := hmac.New(sha256.New, gStickySecret.Load().([]byte))
+	mac.Write([]byte(self.name + "|" + id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// stickyItem returns the entry named by sticky cookie of req if it is valid, available and
+// not tried by previous attempts
+func (self *upstreamGroup) stickyItem(req *http.Request) *upstreamItem {
+	if req == nil {
+		return nil
+	}
+	cookie, err := req.Cookie(self.sticky.cookie)
+	if err != nil {
+		return nil
+	}
+
+	idx := strings.Index(cookie.Value, ".")
+	if idx < 0 {
+		return nil
+	}
+	id, sign := cookie.Value[:idx], cookie.Value[idx+1:]
+	if !hmac.Equal([]byte(sign), []byte(self.stickySign(id))) {
+		return nil
+	}
+
+	tried := triedEntries(req)
+	for _, item := range self.entries {
+		if stickyID(item) == id {
+			if item.usable() && !tried[item] {
+				return item
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// stickyCookie creates the cookie routing later requests to item
+func (self *upstreamGroup) stickyCookie(req *http.Request, item *upstreamItem) *http.Cookie {
+	id := stickyID(item)
+	ret := &http.Cookie{
+		Name:     self.sticky.cookie,
+		Value:    id + "." + self.stickySign(id),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if self.sticky.ttl > 0 {
+		ret.MaxAge = int(self.sticky.ttl / time.Second)
+	}
+	return ret
+}
@@ -1,13 +1,21 @@
 package env
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func testRoundRobin(domain string, expect []string) error {
@@ -74,3 +82,561 @@ func TestUpstream(t *testing.T) {
 
 	crc32.ChecksumIEEE([]byte{})
 }
+
+func TestHealthCheck(t *testing.T) {
+	healthy := int32(1)
+	good := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/healthz" || atomic.LoadInt32(&healthy) == 0 {
+			rsp.WriteHeader(503)
+		}
+	}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		rsp.WriteHeader(500)
+	}))
+	defer bad.Close()
+
+	good_addr := strings.TrimPrefix(good.URL, "http://")
+	bad_addr := strings.TrimPrefix(bad.URL, "http://")
+
+	raw := map[string][]string{
+		"hc round_robin check=http check_path=/healthz check_interval=10ms rise=1 fall=1": {bad_addr, good_addr},
+	}
+	if err := AddUpsteam(raw); err != nil {
+		t.Errorf("build upstream failed: %v", err)
+		return
+	}
+	defer SetUpstream(make(UpstreamMap))
+
+	wait := func(expect map[string]bool) error {
+		for i := 0; i < 200; i++ {
+			result := map[string]bool{}
+			for j := 0; j < 4; j++ {
+				result[UpstreamAddr("hc", nil)] = true
+			}
+			if len(result) == len(expect) {
+				ok := true
+				for addr := range result {
+					ok = ok && expect[addr]
+				}
+				if ok {
+					return nil
+				}
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		return fmt.Errorf("upstream entries not as expected: %v", expect)
+	}
+
+	//unhealthy entry is skipped
+	if err := wait(map[string]bool{good_addr: true}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	//all entries are used when every one is down
+	atomic.StoreInt32(&healthy, 0)
+	if err := wait(map[string]bool{good_addr: true, bad_addr: true}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := BuildUpstream(map[string][]string{"hc check_path=/": {"A"}}); err == nil {
+		t.Errorf("check_path without check should fail")
+	}
+}
+
+func TestCheckReplaced(t *testing.T) {
+	probing := make(chan struct{}, 16)
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		probing <- struct{}{}
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	addr := strings.TrimPrefix(slow.URL, "http://")
+	if err := AddUpsteam(map[string][]string{"hc_slow check=http check_interval=10ms check_timeout=5s fall=1": {addr}}); err != nil {
+		t.Errorf("build upstream failed: %v", err)
+		return
+	}
+	defer SetUpstream(make(UpstreamMap))
+	<-probing
+
+	//the probe in progress is canceled, and not counted as a failure
+	begin := time.Now()
+	if _, err := SetEntryWeight("hc_slow", addr, 2); err != nil {
+		t.Error(err)
+		return
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Errorf("replacing group waits for probes too long: %v", elapsed)
+	}
+
+	gUpstreamLock.RLock()
+	item := gUpstreamMap["hc_slow"].entries[0]
+	gUpstreamLock.RUnlock()
+	if atomic.LoadInt32(&(item.healthy)) != 1 {
+		t.Errorf("canceled probe should not mark the entry down")
+	}
+}
+
+func TestLeastConn(t *testing.T) {
+	err := AddUpsteam(map[string][]string{
+		"lc least_conn":    {"A", "B weight=2"},
+		"ll least_latency": {"A", "B"},
+	})
+	if err != nil {
+		t.Errorf("build upstream failed: %v", err)
+		return
+	}
+
+	//keep requests in flight, B should take twice as many as A
+	count := map[string]int{}
+	attempts := []*Attempt{}
+	for i := 0; i < 6; i++ {
+		req := WrapRequest(httptest.NewRequest("GET", "/", nil))
+		count[UpstreamAddr("lc", req)]++
+		attempts = append(attempts, SendAttempt(req))
+	}
+	if count["A"] != 2 || count["B"] != 4 {
+		t.Errorf("least_conn not as expected: %v", count)
+	}
+	for _, item := range attempts {
+		item.Close()
+	}
+
+	gUpstreamLock.RLock()
+	group := gUpstreamMap["ll"]
+	gUpstreamLock.RUnlock()
+	group.entries[0].updateLatency(time.Millisecond * 100)
+	group.entries[1].updateLatency(time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		if addr := UpstreamAddr("ll", nil); addr != "B" {
+			t.Errorf("least_latency should choose the faster entry: %s", addr)
+			return
+		}
+	}
+}
+
+func TestMaxConnsBurst(t *testing.T) {
+	if err := AddUpsteam(map[string][]string{"burst": {"A max_conns=3", "B max_conns=3"}}); err != nil {
+		t.Errorf("build upstream failed: %v", err)
+		return
+	}
+	gUpstreamLock.RLock()
+	group := gUpstreamMap["burst"]
+	gUpstreamLock.RUnlock()
+
+	//concurrent requests never pick more than max_conns slots of an entry
+	reqs := make([]*http.Request, 64)
+	picked := int32(0)
+	wg := sync.WaitGroup{}
+	start := make(chan bool)
+	for idx := range reqs {
+		reqs[idx] = WrapRequest(httptest.NewRequest("GET", "/", nil))
+		wg.Add(1)
+		go func(req *http.Request) {
+			defer wg.Done()
+			<-start
+			if UpstreamAddr("burst", req) != "" {
+				atomic.AddInt32(&picked, 1)
+			}
+		}(reqs[idx])
+	}
+	close(start)
+	wg.Wait()
+
+	if picked != 6 {
+		t.Errorf("picked slots not as expected: %d", picked)
+	}
+	for _, item := range group.entries {
+		if n := atomic.LoadInt32(&(item.inflight)); n != 3 {
+			t.Errorf("in flight requests of %s not as expected: %d", item.addr, n)
+		}
+	}
+
+	//slots picked but never sent are released when requests finish
+	attempt := SendAttempt(reqs[0])
+	for _, req := range reqs {
+		FinishRequest(req)
+	}
+	total := int32(0)
+	for _, item := range group.entries {
+		total += atomic.LoadInt32(&(item.inflight))
+	}
+	if expect := int32(len(attempt.picks)); total != expect {
+		t.Errorf("unsent picks should be released: in flight=%d expected=%d", total, expect)
+	}
+	attempt.Close()
+}
+
+func TestWeightInflight(t *testing.T) {
+	if err := AddUpsteam(map[string][]string{"wt round_robin": {"A max_conns=1", "B max_conns=1"}}); err != nil {
+		t.Errorf("build upstream failed: %v", err)
+		return
+	}
+	defer SetUpstream(make(UpstreamMap))
+
+	req := WrapRequest(httptest.NewRequest("GET", "/", nil))
+	addr := UpstreamAddr("wt", req)
+	attempt := SendAttempt(req)
+
+	//requests in flight are kept by weight changes, so max_conns still holds
+	status, err := SetEntryWeight("wt", addr, 3)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if status.Weight != 3 || status.Inflight != 1 {
+		t.Errorf("status of %s not as expected: %+v", addr, status)
+	}
+	for i := 0; i < 4; i++ {
+		other := WrapRequest(httptest.NewRequest("GET", "/", nil))
+		if picked := UpstreamAddr("wt", other); picked == addr {
+			t.Errorf("full entry %s should not be picked", addr)
+		}
+		FinishRequest(other)
+	}
+
+	attempt.Close()
+	FinishRequest(req)
+	for _, group := range UpstreamStatus() {
+		for _, entry := range group.Entries {
+			if group.Name == "wt" && entry.Inflight != 0 {
+				t.Errorf("in flight requests of %s not released: %d", entry.Addr, entry.Inflight)
+			}
+		}
+	}
+}
+
+func TestHashRing(t *testing.T) {
+	entries := []*upstreamItem{
+		{addr: "A", weight: 1, healthy: 1},
+		{addr: "B", weight: 1, healthy: 1},
+		{addr: "C", weight: 2, healthy: 1},
+	}
+	usable := map[*upstreamItem]bool{}
+	for _, item := range entries {
+		usable[item] = true
+	}
+
+	ring := newHashRing(entries)
+	before := map[string]string{}
+	count := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		key := fmt.Sprint("user_", i)
+		before[key] = ring.lookup(key, usable).addr
+		count[before[key]]++
+	}
+	if count["C"] < count["A"]*3/2 || count["C"] < count["B"]*3/2 {
+		t.Errorf("weight is not respected by hash ring: %v", count)
+	}
+
+	//adding an entry only moves keys to the new entry
+	entries = append(entries, &upstreamItem{addr: "D", weight: 1, healthy: 1})
+	usable[entries[3]] = true
+	ring = newHashRing(entries)
+	for key, addr := range before {
+		if tmp := ring.lookup(key, usable).addr; tmp != addr && tmp != "D" {
+			t.Errorf("key %s moved from %s to %s", key, addr, tmp)
+			return
+		}
+	}
+
+	//keys of unusable entry go to other entries
+	delete(usable, entries[0])
+	for key := range before {
+		if ring.lookup(key, usable).addr == "A" {
+			t.Errorf("key %s is mapped to unusable entry", key)
+			return
+		}
+	}
+
+	if _, err := BuildUpstream(map[string][]string{"hh hash hash_key=cookie:sid": {"A", "B weight=3"}}); err != nil {
+		t.Error(err)
+	}
+	if _, err := BuildUpstream(map[string][]string{"hh hash": {"A"}}); err == nil {
+		t.Errorf("hash strategy without hash_key should fail")
+	}
+}
+
+func TestEntryOptions(t *testing.T) {
+	err := AddUpsteam(map[string][]string{
+		"eo_backup":     {"B backup", "A", "C down"},
+		"eo_max_conns":  {"A max_conns=1", "B max_conns=1"},
+		"eo_slow_start": {"A slow_start=1h", "B"},
+	})
+	if err != nil {
+		t.Errorf("build upstream failed: %v", err)
+		return
+	}
+
+	gUpstreamLock.RLock()
+	backup, slow := gUpstreamMap["eo_backup"], gUpstreamMap["eo_slow_start"]
+	gUpstreamLock.RUnlock()
+
+	//backup is used only when primary entries are down, disabled entry is never used
+	for i := 0; i < 4; i++ {
+		if addr := UpstreamAddr("eo_backup", nil); addr != "A" {
+			t.Errorf("primary entry should be used: %s", addr)
+			return
+		}
+	}
+	backup.entries[0].healthy = 0
+	for i := 0; i < 4; i++ {
+		if addr := UpstreamAddr("eo_backup", nil); addr != "B" {
+			t.Errorf("backup entry should be used: %s", addr)
+			return
+		}
+	}
+
+	//entries reaching max_conns are skipped, and no entry is returned if all are full
+	attempts := []*Attempt{}
+	for i := 0; i < 2; i++ {
+		req := WrapRequest(httptest.NewRequest("GET", "/", nil))
+		UpstreamAddr("eo_max_conns", req)
+		attempts = append(attempts, SendAttempt(req))
+	}
+	req := WrapRequest(httptest.NewRequest("GET", "/", nil))
+	if addr := UpstreamAddr("eo_max_conns", req); addr != "" || !NoUpstream(req) {
+		t.Errorf("no entry should be available when all reach max_conns: %s", addr)
+	}
+	attempts[0].Close()
+	if addr := UpstreamAddr("eo_max_conns", nil); addr == "" {
+		t.Errorf("entry should be available after a request finishes")
+	}
+	attempts[1].Close()
+
+	//entry in slow start takes only a small part of requests
+	slow.entries[0].recover_at = time.Now().UnixNano()
+	count := map[string]int{}
+	for i := 0; i < 400; i++ {
+		count[UpstreamAddr("eo_slow_start", nil)]++
+	}
+	if count["A"] > 100 {
+		t.Errorf("entry in slow start takes too many requests: %v", count)
+	}
+
+	if _, err := BuildUpstream(map[string][]string{"eo": {"A max_conns=0"}}); err == nil {
+		t.Errorf("invalid max_conns should fail")
+	}
+}
+
+type stubResolver struct {
+	lock  sync.Mutex
+	hosts map[string][]string
+	srvs  map[string][]*net.SRV
+}
+
+func (self *stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ret := []net.IPAddr{}
+	for _, ip := range self.hosts[host] {
+		ret = append(ret, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	if len(ret) == 0 {
+		return nil, errors.New("no such host " + host)
+	}
+	return ret, nil
+}
+
+func (self *stubResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return name, self.srvs[name], nil
+}
+
+func (self *stubResolver) setHosts(host string, ips ...string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.hosts[host] = ips
+}
+
+func TestDnsDiscovery(t *testing.T) {
+	resolver := &stubResolver{
+		hosts: map[string][]string{"api.internal": {"10.0.0.1", "10.0.0.2"}},
+		srvs: map[string][]*net.SRV{"_http._tcp.api.internal": {
+			{Target: "a.api.internal.", Port: 8080, Priority: 1, Weight: 3},
+			{Target: "b.api.internal.", Port: 8080, Priority: 2, Weight: 1},
+		}},
+	}
+	SetResolver(resolver)
+	defer SetUpstream(make(UpstreamMap))
+
+	err := AddUpsteam(map[string][]string{
+		"dns_test": {"dns+api.internal:80 refresh=10ms", "10.0.0.9:80 backup"},
+		"srv_test": {"srv+_http._tcp.api.internal"},
+	})
+	if err != nil {
+		t.Errorf("build upstream failed: %v", err)
+		return
+	}
+
+	entries := func(name string) map[string]string {
+		gUpstreamLock.RLock()
+		group := gUpstreamMap[name]
+		gUpstreamLock.RUnlock()
+		ret := map[string]string{}
+		for _, item := range group.entries {
+			ret[item.addr] = fmt.Sprintf("weight=%d backup=%v", item.weight, item.backup)
+		}
+		return ret
+	}
+
+	expect := map[string]string{
+		"a.api.internal:8080": "weight=3 backup=false",
+		"b.api.internal:8080": "weight=1 backup=true",
+	}
+	if tmp := entries("srv_test"); fmt.Sprint(tmp) != fmt.Sprint(expect) {
+		t.Errorf("srv entries not as expected: %v", tmp)
+	}
+
+	if tmp := entries("dns_test"); len(tmp) != 3 || len(tmp["10.0.0.1:80"]) == 0 || len(tmp["10.0.0.2:80"]) == 0 {
+		t.Errorf("dns entries not as expected: %v", tmp)
+		return
+	}
+
+	//entries follow DNS changes, and lookup failures keep the last result
+	resolver.setHosts("api.internal", "10.0.0.2", "10.0.0.3")
+	for i := 0; i < 200; i++ {
+		if tmp := entries("dns_test"); len(tmp["10.0.0.3:80"]) > 0 && len(tmp["10.0.0.1:80"]) == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	resolver.setHosts("api.internal")
+	time.Sleep(time.Millisecond * 50)
+	if tmp := entries("dns_test"); len(tmp) != 3 || len(tmp["10.0.0.3:80"]) == 0 {
+		t.Errorf("dns entries not updated: %v", tmp)
+	}
+}
+
+func TestDnsAdminChanges(t *testing.T) {
+	resolver := &stubResolver{hosts: map[string][]string{"admin.internal": {"10.0.1.1", "10.0.1.2"}}}
+	SetResolver(resolver)
+	defer SetUpstream(make(UpstreamMap))
+
+	if err := AddUpsteam(map[string][]string{"dns_admin": {"dns+admin.internal:80 refresh=10ms", "10.0.1.9:80"}}); err != nil {
+		t.Errorf("build upstream failed: %v", err)
+		return
+	}
+
+	entries := func() map[string]string {
+		gUpstreamLock.RLock()
+		group := gUpstreamMap["dns_admin"]
+		gUpstreamLock.RUnlock()
+		ret := map[string]string{}
+		for _, item := range group.entries {
+			ret[item.addr] = fmt.Sprintf("weight=%d drained=%v", item.weight, item.disabled())
+		}
+		return ret
+	}
+	wait := func(addr string, present bool) {
+		for i := 0; i < 200; i++ {
+			if _, ok := entries()[addr]; ok == present {
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	if _, err := SetEntryWeight("dns_admin", "10.0.1.1:80", 5); err != nil {
+		t.Error(err)
+	}
+	if _, err := SetEntryWeight("dns_admin", "10.0.1.9:80", 2); err != nil {
+		t.Error(err)
+	}
+	if _, err := DrainEntry("dns_admin", "10.0.1.2:80", true); err != nil {
+		t.Error(err)
+	}
+
+	//changes survive DNS changes, including entries which are gone and come back
+	resolver.setHosts("admin.internal", "10.0.1.1", "10.0.1.3")
+	wait("10.0.1.2:80", false)
+	resolver.setHosts("admin.internal", "10.0.1.1", "10.0.1.2")
+	wait("10.0.1.2:80", true)
+
+	expect := map[string]string{
+		"10.0.1.1:80": "weight=5 drained=false",
+		"10.0.1.2:80": "weight=1 drained=true",
+		"10.0.1.9:80": "weight=2 drained=false",
+	}
+	if tmp := entries(); fmt.Sprint(tmp) != fmt.Sprint(expect) {
+		t.Errorf("admin changes not kept after DNS changes: %v", tmp)
+	}
+}
+
+func TestProxyHeader(t *testing.T) {
+	if err := AddUpsteam(map[string][]string{
+		"pp_v1 round_robin proxy_protocol=v1": {"A"},
+		"pp_v2 round_robin proxy_protocol=v2": {"A"},
+		"pp_none":                             {"A"},
+	}); err != nil {
+		t.Errorf("build upstream failed: %v", err)
+		return
+	}
+	if err := AddUpsteam(map[string][]string{"pp_bad proxy_protocol=v3": {"A"}}); err == nil {
+		t.Errorf("invalid proxy_protocol should fail")
+	}
+
+	v2 := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0x11, 0, 12, 1, 2, 3, 4, 10, 0, 0, 1, 0x1F, 0x90, 0, 80)
+	cases := []struct {
+		group  string
+		remote string
+		expect string
+	}{
+		{"pp_v1", "1.2.3.4:8080", "PROXY TCP4 1.2.3.4 10.0.0.1 8080 80\r\n"},
+		{"pp_v1", "[2001:db8::1]:8080", "PROXY TCP6 2001:db8::1 ::ffff:10.0.0.1 8080 80\r\n"},
+		{"pp_v1", "@", "PROXY UNKNOWN\r\n"},
+		{"pp_v2", "1.2.3.4:8080", string(v2)},
+		{"pp_none", "1.2.3.4:8080", ""},
+	}
+	for _, item := range cases {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = item.remote
+		req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}))
+		req = WrapRequest(req)
+
+		UpstreamAddr(item.group, req)
+		if header := ProxyHeader(req); string(header) != item.expect {
+			t.Errorf("PROXY header of %s from %s not as expected: %q", item.group, item.remote, header)
+		}
+	}
+
+	//health checks send headers without addresses
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ln.Close()
+	ch_header := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			ch_header <- ""
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 16)
+		n, _ := io.ReadFull(conn, buf)
+		ch_header <- string(buf[:n])
+	}()
+
+	check, _ := parseHealthCheck(map[string]string{"check": "tcp"})
+	check.proxy_protocol = proxy_v2
+	if err := check.probe(context.Background(), ln.Addr().String()); err != nil {
+		t.Error(err)
+		return
+	}
+	if header := <-ch_header; header != "\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00" {
+		t.Errorf("PROXY header of health check not as expected: %q", header)
+	}
+}
@@ -2,141 +2,543 @@ package env
 
 import (
 	"errors"
-	"hash/crc32"
 	"math/rand"
 	"net/http"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const us_round_robin int = 1
 const us_random int = 2
 const us_client_hash int = 3
+const us_least_conn int = 4
+const us_least_latency int = 5
+const us_hash int = 6
 
 type upstreamItem struct {
 	addr   string
-	weight int
+	weight int32 // changed in place by admin, accessed atomically
+
+	backup     bool          // used only when all primary entries are unavailable
+	down       bool          // disabled in config
+	max_conns  int32         // max requests in flight, 0 for unlimited
+	slow_start time.Duration // time to ramp weight up after the entry recovers
+
+	healthy int32 // 1 if the entry passes active health checks, accessed atomically
+
+	//consecutive check results, used by the checker goroutine of the group only
+	check_success int
+	check_failure int
+
+	fails      int32 // consecutive failed requests, accessed atomically
+	down_until int64 // unix nano until which the entry is marked down by failed requests
+
+	inflight int32  // requests and websocket tunnels in progress, accessed atomically
+	latency  uint64 // float64 bits of response time EWMA in nanoseconds, accessed atomically
+
+	recover_at int64 // unix nano when the entry becomes available again, accessed atomically
+
+	drained int32 // 1 if new requests are stopped by admin, accessed atomically
+}
+
+// disabled tells whether the entry is disabled in config or drained by admin
+func (self *upstreamItem) disabled() bool {
+	return self.down || atomic.LoadInt32(&(self.drained)) == 1
+}
+
+func (self *upstreamItem) available() bool {
+	return !self.disabled() && atomic.LoadInt32(&(self.healthy)) == 1 && time.Now().UnixNano() >= atomic.LoadInt64(&(self.down_until))
+}
+
+func (self *upstreamItem) full() bool {
+	return self.max_conns > 0 && atomic.LoadInt32(&(self.inflight)) >= self.max_conns
+}
+
+// reserve counts a new in flight request on the entry, it fails if the entry reaches max_conns
+func (self *upstreamItem) reserve() bool {
+	for {
+		n := atomic.LoadInt32(&(self.inflight))
+		if self.max_conns > 0 && n >= self.max_conns {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&(self.inflight), n, n+1) {
+			return true
+		}
+	}
+}
+
+func (self *upstreamItem) release() {
+	atomic.AddInt32(&(self.inflight), -1)
+}
+
+// usable tells whether the entry can take a new request
+func (self *upstreamItem) usable() bool {
+	return self.available() && !self.full()
+}
+
+// rampFactor is less than 1 while the entry is in slow start after recovery
+func (self *upstreamItem) rampFactor() float64 {
+	if self.slow_start <= 0 {
+		return 1
+	}
+	recover_at := atomic.LoadInt64(&(self.recover_at))
+	if recover_at == 0 {
+		return 1
+	}
+	elapsed := time.Duration(time.Now().UnixNano() - recover_at)
+	if elapsed >= self.slow_start {
+		return 1
+	}
+	if elapsed < self.slow_start/20 {
+		return 0.05
+	}
+	return float64(elapsed) / float64(self.slow_start)
+}
+
+func (self *upstreamItem) curWeight() int {
+	return int(atomic.LoadInt32(&(self.weight)))
+}
+
+func (self *upstreamItem) effectiveWeight() float64 {
+	return float64(self.curWeight()) * self.rampFactor()
+}
+
+// admitted lets an entry in slow start take requests with probability of its ramp factor
+func (self *upstreamItem) admitted() bool {
+	factor := self.rampFactor()
+	return factor >= 1 || rand.Float64() < factor
 }
 
 type upstreamGroup struct {
+	name     string
 	strategy int
 
-	entries []upstreamItem
+	entries  []*upstreamItem // primary entries first, then backup entries
+	weighted []int           // indexes of entries shared by weight in round robin
+	weights  []uint32        // weights of weighted entries when the group is built
 
 	mod          uint32
 	curr_idx     uint32
 	total_weight uint32
+
+	check   *healthCheck // nil if active health check is not configured
+	ch_stop chan struct{}
+	ch_done chan struct{} // closed when the checker exits
+
+	passive *passiveCheck // nil if passive failure detection is not configured
+
+	ring     hashRing                   // for client_hash and hash strategies
+	hash_key func(*http.Request) string // for client_hash and hash strategies
+
+	sticky *stickySession // nil if sticky session is not configured
+
+	discovery *discovery // nil if no entry is resolved from DNS
+
+	proxy_protocol int // PROXY protocol version sent to entries, 0 if not sent
 }
 
-var gUpstreamMap map[string]*upstreamGroup = make(map[string]*upstreamGroup)
+type UpstreamMap map[string]*upstreamGroup
 
-var matchUpstreamName *regexp.Regexp = regexp.MustCompile(`^([^ \t]+)([ \t]+[^ \t]+)?$`)
-var matchUpstreamEntry *regexp.Regexp = regexp.MustCompile(`^([^ \t]+)([ \t]+weight=[0-9]+)?$`)
+var gUpstreamLock sync.RWMutex
+var gUpstreamMap UpstreamMap = make(UpstreamMap)
 
 var strategy2int map[string]int = map[string]int{
-	"round_robin": us_round_robin,
-	"random":      us_random,
-	"client_hash": us_client_hash,
+	"round_robin":   us_round_robin,
+	"random":        us_random,
+	"client_hash":   us_client_hash,
+	"least_conn":    us_least_conn,
+	"least_latency": us_least_latency,
+	"hash":          us_hash,
 }
 
+// AddUpsteam builds upstream groups from conf and merges them into the running set.
 func AddUpsteam(conf map[string][]string) error {
+	upstream, err := BuildUpstream(conf)
+	if err != nil {
+		return err
+	}
+
+	gUpstreamSwap.Lock()
+	gUpstreamLock.RLock()
+	merged := make(UpstreamMap)
+	for name, group := range gUpstreamMap {
+		merged[name] = group
+	}
+	gUpstreamLock.RUnlock()
+
+	for name, group := range upstream {
+		merged[name] = group
+	}
+	stopped := setUpstream(merged)
+	gUpstreamSwap.Unlock()
+
+	stopDiscovery(stopped)
+	return nil
+}
+
+// SetUpstream replaces the running set of upstream groups as a whole. Health states of
+// entries are kept for addresses which are still in the same group. Entries from DNS are
+// resolved before the groups take requests.
+func SetUpstream(upstream UpstreamMap) {
+	gUpstreamSwap.Lock()
+	stopped := setUpstream(upstream)
+	gUpstreamSwap.Unlock()
+
+	stopDiscovery(stopped)
+}
+
+// stopDiscovery stops discoveries of replaced groups. gUpstreamSwap should not be held, since
+// a discovery may be waiting for it to swap its group.
+func stopDiscovery(stopped []*discovery) {
+	for _, item := range stopped {
+		item.stop()
+	}
+}
+
+// setUpstream swaps in upstream, and returns discoveries no longer used, which should be
+// stopped after gUpstreamSwap is released
+func setUpstream(upstream UpstreamMap) []*discovery {
+	gUpstreamLock.RLock()
+	old := gUpstreamMap
+	gUpstreamLock.RUnlock()
+
+	//resolve new groups in parallel
+	next_resolve := make(map[string]time.Time)
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for name, group := range upstream {
+		if group.discovery == nil || (old[name] != nil && old[name].discovery == group.discovery) {
+			continue
+		}
+		if prev, ok := old[name]; ok && prev.discovery != nil {
+			group.discovery.inherit(prev.discovery)
+		}
+
+		wg.Add(1)
+		go func(name string, group *upstreamGroup) {
+			defer wg.Done()
+			_, next := group.discovery.resolveAll(name, true)
+			lock.Lock()
+			next_resolve[name] = next
+			lock.Unlock()
+		}(name, group)
+	}
+	wg.Wait()
+
+	for name, next := range next_resolve {
+		upstream[name] = upstream[name].rebuild()
+		upstream[name].discovery.start(name, next)
+	}
+
+	for name, group := range upstream {
+		if prev, ok := old[name]; ok && prev != group {
+			group.inheritHealth(prev)
+		}
+		group.startCheck()
+	}
+
+	gUpstreamLock.Lock()
+	gUpstreamMap = upstream
+	gUpstreamLock.Unlock()
+
+	stopped := make([]*discovery, 0)
+	for name, group := range old {
+		if upstream[name] != group {
+			group.stopCheck()
+		}
+		if group.discovery != nil && (upstream[name] == nil || upstream[name].discovery != group.discovery) {
+			stopped = append(stopped, group.discovery)
+		}
+	}
+	return stopped
+}
+
+// BuildUpstream parses conf into upstream groups without touching the running set.
+//
+// Keys are "NAME [STRATEGY] [option=value ...]", entries are "ADDR [option ...]", or DNS
+// records "dns+HOST:PORT" and "srv+NAME" which are resolved when the group is set.
+func BuildUpstream(conf map[string][]string) (UpstreamMap, error) {
+	ret := make(UpstreamMap)
+
 	for name, entry_list := range conf {
-		key := strings.Trim(name, " \r\n\t")
-		match := matchUpstreamName.FindAllSubmatchIndex([]byte(key), -1)
-		if len(match) == 0 {
-			return errors.New("Malformed upstream name: " + key)
+		fields := strings.Fields(name)
+		if len(fields) == 0 {
+			return nil, errors.New("Malformed upstream name: " + name)
 		}
+		key := strings.Join(fields, " ")
 
 		if len(entry_list) == 0 {
-			return errors.New("No address in upstream " + key)
+			return nil, errors.New("No address in upstream " + key)
 		}
 
-		domain := key[match[0][2]:match[0][3]]
+		domain := fields[0]
+		fields = fields[1:]
 		strategy := "round_robin"
 
-		if match[0][4] != match[0][5] {
-			strategy = strings.Trim(key[match[0][4]:match[0][5]], " \r\n\t")
+		if len(fields) > 0 && !strings.Contains(fields[0], "=") {
+			strategy = fields[0]
+			fields = fields[1:]
 		}
 
-		if strategy != "round_robin" && strategy != "random" && strategy != "client_hash" {
-			return errors.New("Invalid strategy '" + strategy + "' for upstream " + domain)
+		if _, ok := strategy2int[strategy]; !ok {
+			return nil, errors.New("Invalid strategy '" + strategy + "' for upstream " + domain)
 		}
 
 		group := &upstreamGroup{
+			name:     domain,
 			strategy: strategy2int[strategy],
-			entries:  make([]upstreamItem, 0),
+			entries:  make([]*upstreamItem, 0),
+		}
+
+		if err := group.parseOptions(fields); err != nil {
+			return nil, errors.New("upstream " + domain + ": " + err.Error())
 		}
 
 		for _, entry_str := range entry_list {
-			entry_bytes := []byte(strings.Trim(entry_str, " \r\n\t"))
-			match := matchUpstreamEntry.FindAllSubmatchIndex(entry_bytes, -1)
-			if len(match) == 0 {
-				return errors.New("Malformed address for " + domain + " : " + entry_str)
+			entry_fields := strings.Fields(entry_str)
+			if len(entry_fields) == 0 {
+				return nil, errors.New("Malformed address for " + domain + " : " + entry_str)
 			}
 
-			addr := string(entry_bytes[match[0][2]:match[0][3]])
-			weight := 1
-
-			if match[0][4] != match[0][5] {
-				weight_str := string(entry_bytes[match[0][4]:match[0][5]])
-				eq_idx := strings.Index(weight_str, "=")
-
-				var err error
-				weight, err = strconv.Atoi(weight_str[eq_idx+1:])
+			if isDnsEntry(entry_fields[0]) {
+				record, err := parseDnsRecord(entry_fields)
 				if err != nil {
-					return err
+					return nil, errors.New("Malformed address for " + domain + " : " + entry_str + ": " + err.Error())
 				}
+				if group.discovery == nil {
+					group.discovery = &discovery{}
+				}
+				group.discovery.records = append(group.discovery.records, record)
+				continue
 			}
 
-			if weight < 1 {
-				return errors.New("upstream addr " + addr + " weight cannot be less than 1")
+			item := &upstreamItem{addr: entry_fields[0], weight: 1, healthy: 1}
+			if err := item.parseOptions(entry_fields[1:]); err != nil {
+				return nil, errors.New("Malformed address for " + domain + " : " + entry_str + ": " + err.Error())
 			}
 
-			group.entries = append(group.entries, upstreamItem{addr: addr, weight: weight})
-			group.total_weight += uint32(weight)
+			group.entries = append(group.entries, item)
+		}
+		if group.discovery != nil {
+			group.discovery.static = group.entries
+		}
+		group.sortEntries()
+
+		if group.strategy == us_client_hash || group.strategy == us_hash {
+			group.ring = newHashRing(group.entries)
 		}
 
-		gUpstreamMap[domain] = group
+		ret[domain] = group
+	}
+	return ret, nil
+}
+
+// parseOptions parses options following entry address:
+//
+//	weight=N  backup  down  max_conns=N  slow_start=30s
+func (self *upstreamItem) parseOptions(options []string) error {
+	var err error
+	for _, option := range options {
+		switch {
+		case option == "backup":
+			self.backup = true
+		case option == "down":
+			self.down = true
+		case strings.HasPrefix(option, "weight="):
+			var n int
+			n, err = strconv.Atoi(option[len("weight="):])
+			if err == nil && n < 1 {
+				err = errors.New("weight cannot be less than 1")
+			}
+			self.weight = int32(n)
+		case strings.HasPrefix(option, "max_conns="):
+			var n int
+			n, err = positiveInt("max_conns", option[len("max_conns="):])
+			self.max_conns = int32(n)
+		case strings.HasPrefix(option, "slow_start="):
+			self.slow_start, err = time.ParseDuration(option[len("slow_start="):])
+			if err == nil && self.slow_start <= 0 {
+				err = errors.New("slow_start should be positive")
+			}
+		default:
+			err = errors.New("unknown option " + option)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortEntries moves backup entries to the end, and sets up round robin weights of primary entries
+func (self *upstreamGroup) sortEntries() {
+	sort.SliceStable(self.entries, func(i, j int) bool {
+		return !self.entries[i].backup && self.entries[j].backup
+	})
+
+	for _, backup := range []bool{false, true} {
+		for idx, item := range self.entries {
+			if item.backup == backup && !item.down {
+				weight := uint32(item.curWeight())
+				self.weighted = append(self.weighted, idx)
+				self.weights = append(self.weights, weight)
+				self.total_weight += weight
+			}
+		}
+		if len(self.weighted) > 0 {
+			return
+		}
+	}
+	self.total_weight = 1
+}
+
+// parseOptions parses "option=value" fields following upstream name and strategy
+func (self *upstreamGroup) parseOptions(fields []string) error {
+	options := make(map[string]string)
+	for _, field := range fields {
+		idx := strings.Index(field, "=")
+		if idx <= 0 {
+			return errors.New("Malformed option " + field)
+		}
+		if _, ok := options[field[:idx]]; ok {
+			return errors.New("duplicate option " + field[:idx])
+		}
+		options[field[:idx]] = field[idx+1:]
+	}
+
+	var err error
+	if self.proxy_protocol, err = parseProxyProtocol(options); err != nil {
+		return err
+	}
+
+	check, err := parseHealthCheck(options)
+	if err != nil {
+		return err
+	}
+	if check != nil {
+		check.proxy_protocol = self.proxy_protocol
+	}
+	self.check = check
+
+	passive, err := parsePassiveCheck(options)
+	if err != nil {
+		return err
+	}
+	self.passive = passive
+
+	if key, ok := options["hash_key"]; ok {
+		delete(options, "hash_key")
+		if self.strategy != us_hash {
+			return errors.New("hash_key is only available for hash strategy")
+		}
+		if self.hash_key, err = parseHashKey(key); err != nil {
+			return err
+		}
+	} else if self.strategy == us_hash {
+		return errors.New("hash strategy requires hash_key option")
+	} else if self.strategy == us_client_hash {
+		self.hash_key = clientIP
+	}
+
+	if self.sticky, err = parseSticky(options); err != nil {
+		return err
+	}
+
+	for key := range options {
+		return errors.New("unknown option " + key)
 	}
 	return nil
 }
 
 func UpstreamAddr(domain string, req *http.Request) string {
+	gUpstreamLock.RLock()
 	group, ok := gUpstreamMap[domain]
+	gUpstreamLock.RUnlock()
+
 	if !ok {
 		return ""
 	}
 
-	return group.getAddr(req)
+	//an entry may reach max_conns by concurrent requests after being chosen, choose again then
+	for tries := 0; tries <= len(group.entries); tries++ {
+		var item *upstreamItem
+		var cookie *http.Cookie
+		if group.sticky != nil {
+			if item = group.stickyItem(req); item == nil {
+				item = group.getAddr(req)
+				if item != nil && req != nil {
+					cookie = group.stickyCookie(req, item)
+				}
+			}
+		} else {
+			item = group.getAddr(req)
+		}
+
+		if item == nil {
+			break
+		}
+		if recordPick(req, group, item, cookie) {
+			return item.addr
+		}
+	}
+
+	recordExhausted(req)
+	return ""
 }
 
-func (self *upstreamGroup) getAddr(req *http.Request) string {
+func (self *upstreamGroup) getAddr(req *http.Request) *upstreamItem {
 	switch self.strategy {
 	case us_round_robin:
-		return self.getAddr_RoundRobin()
+		return self.getAddr_RoundRobin(req)
 	case us_random:
-		return self.getAddr_Random()
-	case us_client_hash:
-		return self.getAddr_ClientHash(req)
+		return self.getAddr_Random(req)
+	case us_client_hash, us_hash:
+		return self.getAddr_Hash(req)
+	case us_least_conn:
+		return self.getAddr_LeastConn(req)
+	case us_least_latency:
+		return self.getAddr_LeastLatency(req)
 	}
-	return ""
+	return nil
+}
+
+// weightedIndex maps n to an entry index, each entry taking a range as long as its weight
+func (self *upstreamGroup) weightedIndex(n uint32) int {
+	n %= self.total_weight
+	for pos, idx := range self.weighted {
+		if n < self.weights[pos] {
+			return idx
+		}
+		n -= self.weights[pos]
+	}
+	return 0
+}
+
+// pick returns the first entry in candidates of req starting from idx, nil if there is none
+func (self *upstreamGroup) pick(idx int, req *http.Request) *upstreamItem {
+	usable := make(map[*upstreamItem]bool)
+	for _, item := range self.candidates(req) {
+		usable[item] = true
+	}
+	for i := 0; i < len(self.entries); i++ {
+		item := self.entries[(idx+i)%len(self.entries)]
+		if usable[item] {
+			return item
+		}
+	}
+	return nil
 }
 
-func (self *upstreamGroup) getAddr_RoundRobin() string {
+func (self *upstreamGroup) getAddr_RoundRobin(req *http.Request) *upstreamItem {
 	idx := atomic.AddUint32(&(self.curr_idx), 1)
 	if idx >= self.total_weight {
 		self.tryMod()
-		idx = idx % self.total_weight
 	}
-	for _, item := range self.entries {
-		if idx < uint32(item.weight) {
-			return item.addr
-		}
-		idx -= uint32(item.weight)
-	}
-	return ""
+	return self.pick(self.weightedIndex(idx), req)
 }
 
 func (self *upstreamGroup) tryMod() {
@@ -151,19 +553,10 @@ func (self *upstreamGroup) tryMod() {
 	}
 }
 
-func (self *upstreamGroup) getAddr_Random() string {
-	return self.entries[rand.Intn(len(self.entries))].addr
-}
-
-func (self *upstreamGroup) getAddr_ClientHash(req *http.Request) string {
-	client_addr := req.RemoteAddr
-	port_idx := strings.Index(client_addr, ":")
-
-	if port_idx >= 0 {
-		client_addr = client_addr[:port_idx]
+func (self *upstreamGroup) getAddr_Random(req *http.Request) *upstreamItem {
+	candidates := self.candidates(req)
+	if len(candidates) == 0 {
+		return nil
 	}
-
-	idx := crc32.ChecksumIEEE([]byte(client_addr)) % self.total_weight
-
-	return self.entries[idx].addr
+	return candidates[rand.Intn(len(candidates))]
 }
@@ -3,8 +3,10 @@ module github.com/zerozwt/Vert
 go 1.14
 
 require (
+	github.com/andybalholm/brotli v1.0.4
 	github.com/gorilla/mux v1.7.4
 	github.com/gorilla/websocket v1.4.2
+	github.com/klauspost/compress v1.11.13
 	golang.org/x/crypto v0.0.0-20200602180216-279210d13fed
 	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// sockets passed by systemd socket activation, key: index and FileDescriptorName
+var gSystemdFiles map[string]*os.File = make(map[string]*os.File)
+
+// initSystemdListeners takes over sockets passed by systemd, see sd_listen_fds(3)
+func initSystemdListeners() {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	const listen_fds_start int = 3
+	for i := 0; i < count; i++ {
+		fd := listen_fds_start + i
+		syscall.CloseOnExec(fd)
+
+		name := strconv.Itoa(i)
+		file := os.NewFile(uintptr(fd), "systemd:"+name)
+		gSystemdFiles[name] = file
+		if i < len(names) && len(names[i]) > 0 {
+			gSystemdFiles[names[i]] = file
+		}
+		INFO_LOG("systemd socket #%d (%s) inherited", i, file.Name())
+	}
+}
+
+// listen opens listener of a slot, the listen address can be:
+//
+//	:80 / 127.0.0.1:80 / [::1]:80   TCP address
+//	unix:/path/to/socket            unix domain socket, file mode is set by socket_mode
+//	systemd:NAME                    socket passed by systemd, NAME is FileDescriptorName or index
+//
+// Connections are expected to start with PROXY protocol headers if proxy_protocol is set.
+func listen(slot *serverSlot) (net.Listener, error) {
+	ln, err := listenAddr(slot)
+	if err != nil || !slot.proxyProtocol {
+		return ln, err
+	}
+	return &proxyListener{Listener: ln}, nil
+}
+
+func listenAddr(slot *serverSlot) (net.Listener, error) {
+	if strings.HasPrefix(slot.listen, "systemd:") {
+		file, ok := gSystemdFiles[slot.listen[len("systemd:"):]]
+		if !ok {
+			return nil, errors.New("no systemd socket for " + slot.listen)
+		}
+		// FileListener dups the fd, so the socket is still available after the listener is closed
+		return net.FileListener(file)
+	}
+
+	if strings.HasPrefix(slot.listen, "unix:") {
+		path := slot.listen[len("unix:"):]
+		// remove stale socket left by a crashed process, but never steal a socket in use
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.Dial("unix", path); err == nil {
+				conn.Close()
+			} else {
+				os.Remove(path)
+			}
+		}
+
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := chmodSocket(slot); err != nil {
+			ln.Close()
+			return nil, err
+		}
+		return ln, nil
+	}
+
+	return net.Listen("tcp", slot.listen)
+}
+
+func chmodSocket(slot *serverSlot) error {
+	if slot.mode == 0 || !strings.HasPrefix(slot.listen, "unix:") {
+		return nil
+	}
+	return os.Chmod(slot.listen[len("unix:"):], slot.mode)
+}
@@ -12,7 +12,7 @@ func INFO_LOG(fmt string, args ...interface{})  { logImp(2, 2, "[INFO]", fmt, ar
 func ERROR_LOG(fmt string, args ...interface{}) { logImp(3, 2, "[ERROR]", fmt, args) }
 
 func logImp(level int, layer int, prefix string, log_fmt string, args []interface{}) {
-	if level < gConf.Base.iLogLevel {
+	if level < curConf().Base.iLogLevel {
 		return
 	}
 	tmNow := time.Now()
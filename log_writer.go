@@ -24,7 +24,7 @@ func doLog(unit logUnit) {
 		logSuffix = unit.suffix
 		logFile = nil
 
-		if tmp, err := os.OpenFile(gConf.Base.LogFile+"."+logSuffix, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644); err != nil {
+		if tmp, err := os.OpenFile(curConf().Base.LogFile+"."+logSuffix, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644); err != nil {
 			return
 		} else {
 			logFile = tmp
@@ -37,6 +37,7 @@ func logLoop() {
 	for {
 		select {
 		case <-logStop:
+			flushLog()
 			if logFile != nil {
 				logFile.Close()
 			}
@@ -48,6 +49,18 @@ func logLoop() {
 	}
 }
 
+// flushLog writes out every log unit still buffered in logCh
+func flushLog() {
+	for {
+		select {
+		case unit := <-logCh:
+			doLog(unit)
+		default:
+			return
+		}
+	}
+}
+
 func joinLog() {
 	close(logStop)
 	<-logJoin
@@ -3,10 +3,12 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -15,47 +17,113 @@ import (
 	"github.com/zerozwt/Vert/env"
 )
 
-func waitSignal(done chan bool) {
+func waitSignal(reload chan chan error, done chan bool) {
 	ch_sig := make(chan os.Signal, 1)
-	signal.Notify(ch_sig, syscall.SIGINT, syscall.SIGTERM)
-	<-ch_sig
-	INFO_LOG("exit signal recieved")
-	close(done)
+	signal.Notify(ch_sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range ch_sig {
+		if sig == syscall.SIGHUP {
+			INFO_LOG("reload signal recieved")
+			ch_ret := make(chan error)
+			reload <- ch_ret
+			if err := <-ch_ret; err != nil {
+				ERROR_LOG("reload config failed, keep running with old config: %v", err)
+			} else {
+				INFO_LOG("reload config succeed")
+			}
+			continue
+		}
+		INFO_LOG("exit signal recieved")
+		close(done)
+		return
+	}
 }
 
 type serverSlot struct {
-	port  int
-	isTls bool
+	listen string // listen address, also key of the slot
+	port   int    // 0 for unix and systemd sockets
+	mode   os.FileMode
+	isTls  bool
+	acme   bool // serves ACME HTTP-01 challenges
+	limits ServerLimits
+
+	proxyProtocol bool // parse PROXY protocol headers, all sites of the slot should agree
 
 	router *mux.Router
+	sites  []siteStatus // sites served by the slot in route order, shown by admin API
 }
 
 func isTls(scheme string) bool { return scheme == "https" }
 
-func buildServerSlots(sites map[string][]SiteConf) (map[int]*serverSlot, error) {
-	ret := make(map[int]*serverSlot)
-	ssl_hosts := make([]string, 0)
+func (self *serverSlot) handler() http.Handler {
+	var ret http.Handler = self.router
+	if self.acme {
+		ret = gCertManager.HTTPHandler(ret)
+	}
+	return logHandler(ret)
+}
+
+func buildServerSlots(root *Conf) (map[string]*serverSlot, *certStore, error) {
+	sites := root.Sites
+	ret := make(map[string]*serverSlot)
+	certs := newCertStore()
+	errs := confErrors{}
+	autocert_sites := make([]*confError, 0) // sites which need HTTP-01 challenge
+	has_autocert := false
 
-	for name, site := range sites {
-		for _, conf := range site {
+	site_listens := make(map[string]bool)
+	for _, name := range orderedSiteNames(sites) {
+		for _, conf := range sites[name] {
 			if conf.Type != "http" && conf.Type != "https" {
-				return nil, errors.New("Invalid site type " + conf.Type + " for " + name)
+				errs.Add(siteError(name, conf.Listen, errors.New("Invalid site type "+conf.Type+" for "+name)))
+				continue
+			}
+
+			//requests would never reach the second site of one host on one address
+			if site_listens[name+" "+conf.Listen] {
+				errs.Add(siteError(name, conf.Listen, errors.New("duplicate site for host "+name+" on "+conf.Listen)))
+				continue
 			}
+			site_listens[name+" "+conf.Listen] = true
 
 			//create slot if not exist
-			slot, ok := ret[conf.Port]
+			slot, ok := ret[conf.Listen]
 			if !ok {
-				ret[conf.Port] = &serverSlot{
+				ret[conf.Listen] = &serverSlot{
+					listen: conf.Listen,
 					port:   conf.Port,
+					mode:   conf.iSocketMode,
 					isTls:  isTls(conf.Type),
 					router: mux.NewRouter(),
+
+					proxyProtocol: conf.ProxyProtocol,
 				}
-				slot = ret[conf.Port]
+				slot = ret[conf.Listen]
 			}
 
 			//check slot type
 			if slot.isTls != isTls(conf.Type) {
-				return nil, errors.New("Invalid type " + conf.Type + " for " + name + ": incompatible with existing sites")
+				errs.Add(siteError(name, conf.Listen, errors.New("Invalid type "+conf.Type+" for "+name+": incompatible with existing sites")))
+				continue
+			}
+
+			//check socket mode
+			if conf.iSocketMode != 0 {
+				if slot.mode != 0 && slot.mode != conf.iSocketMode {
+					errs.Add(siteError(name, conf.Listen, errors.New("socket_mode of "+name+" conflicts with existing sites")))
+					continue
+				}
+				slot.mode = conf.iSocketMode
+			}
+
+			//check PROXY protocol, or sites not expecting it would get their connections rejected
+			if slot.proxyProtocol != conf.ProxyProtocol {
+				errs.Add(siteError(name, conf.Listen, errors.New("proxy_protocol of "+name+" conflicts with existing sites")))
+				continue
+			}
+
+			if err := slot.limits.merge(conf.Limits); err != nil {
+				errs.Add(siteError(name, conf.Listen, err))
+				continue
 			}
 
 			//set certificate info
@@ -65,105 +133,242 @@ func buildServerSlots(sites map[string][]SiteConf) (map[int]*serverSlot, error)
 					SSLKey:   conf.SSLKey,
 					SSLCert:  conf.SSLCert,
 				}
-				if err := setCertInfo(name, info); err != nil {
-					return nil, err
+				if err := certs.Add(name, conf.Listen, info); err != nil {
+					errs.Add(siteError(name, conf.Listen, err))
 				}
 				if conf.AutoCert {
-					ssl_hosts = append(ssl_hosts, name)
+					has_autocert = true
+					if conf.Port != 443 {
+						//TLS-ALPN-01 challenges always come to port 443
+						autocert_sites = append(autocert_sites, siteError(name, conf.Listen,
+							errors.New("autocert site not on port 443 cannot pass TLS-ALPN-01 challenge, acme_http should not be off")))
+					}
 				}
 			}
 
-			//set router for host
-			s := slot.router.Host(name).Subrouter()
+			//build routes in file order
+			routes := make([]*routeSpec, 0, len(conf.Rules))
 			for _, rule := range conf.Rules {
-				for path, actions := range rule {
-					handler := http.NotFoundHandler()
-
-					for i := len(actions) - 1; i >= 0; i-- {
-						var err error
-						handler, err = action.ActionHandler(actions[i], handler)
-						if err != nil {
-							return nil, err
-						}
+				route, err := parseRouteKey(rule.Key)
+				if err != nil {
+					errs.Add(&confError{site: name, listen: conf.Listen, rule: rule.Key, action: -1, err: err})
+					continue
+				}
+
+				handler := http.NotFoundHandler()
+				for i := len(rule.Actions) - 1; i >= 0; i-- {
+					handler, err = action.ActionHandler(rule.Actions[i], handler)
+					if err != nil {
+						errs.Add(&confError{site: name, listen: conf.Listen, rule: rule.Key, action: i, err: err})
+						break
 					}
+				}
+
+				if handler != nil && conf.iMaxBodySize > 0 {
+					handler = action.LimitBody(conf.iMaxBodySize, handler)
+				}
+
+				if handler != nil {
+					route.handler = handler
+					route.actions = rule.Actions
+					routes = append(routes, route)
+				}
+			}
+
+			if conf.LongestPrefix {
+				routes = sortRoutes(routes)
+			}
 
-					s.PathPrefix(path).Handler(handler)
+			//set router for host, requests not matching any rule of the host get 404 here
+			//instead of falling through to wildcard or default sites
+			host_route := slot.router.NewRoute()
+			if name != defaultSiteName {
+				host_route.Host(hostTemplate(name))
+			}
+			if err := host_route.GetError(); err != nil {
+				errs.Add(siteError(name, conf.Listen, err))
+				continue
+			}
+			s := host_route.Subrouter()
+			s.NotFoundHandler = http.NotFoundHandler()
+			site := siteStatus{Name: name, Listen: conf.Listen, Type: conf.Type, AutoCert: conf.AutoCert, Routes: make([]routeStatus, 0, len(routes))}
+			for _, route := range routes {
+				if err := route.register(s); err != nil {
+					errs.Add(&confError{site: name, listen: conf.Listen, rule: route.key, action: -1, err: err})
 				}
+				site.Routes = append(site.Routes, routeStatus{Rule: route.key, Actions: route.actions})
 			}
+			slot.sites = append(slot.sites, site)
+		}
+	}
+
+	//ACME HTTP-01 challenges are served only when some site uses autocert
+	if has_autocert && root.Base.AcmeHttp != acmeHttpOff {
+		if err := setAcmeSlots(ret, root.Base.AcmeHttp); err != nil {
+			errs.Add(err)
+		}
+	} else if has_autocert {
+		for _, err := range autocert_sites {
+			errs.Add(err)
 		}
 	}
 
-	certManagerWhitelist(ssl_hosts...)
-	return ret, nil
+	if err := errs.Err(); err != nil {
+		return nil, nil, err
+	}
+	return ret, certs, nil
+}
+
+// setAcmeSlots marks slots listening on addr as ACME HTTP-01 challenge servers, a slot on
+// addr is created if there is none. For a wildcard address like ":80", all slots on the
+// port are marked.
+func setAcmeSlots(slots map[string]*serverSlot, addr string) error {
+	host, port_str, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(port_str)
+
+	found := false
+	for _, slot := range slots {
+		if slot.listen != addr && (len(host) > 0 || slot.port != port || isSocketListen(slot.listen)) {
+			continue
+		}
+		if slot.isTls {
+			return errors.New("ACME HTTP-01 listener " + slot.listen + " cannot run HTTPS")
+		}
+		slot.acme = true
+		found = true
+	}
+
+	if !found {
+		slots[addr] = &serverSlot{
+			listen: addr,
+			port:   port,
+			acme:   true,
+			router: mux.NewRouter(),
+		}
+	}
+	return nil
 }
 
 func logHandler(underlying http.Handler) http.Handler {
 	return http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
 		INFO_LOG("ACCESS %s %s %s %s %s", req.RemoteAddr, req.Method, req.Host, req.URL.String(), req.Proto)
-		underlying.ServeHTTP(rsp, env.WrapRequest(req))
+		req = env.WrapRequest(req)
+		defer env.FinishRequest(req)
+		underlying.ServeHTTP(rsp, req)
 	})
 }
 
+// vertRuntime holds everything built from one config file, it is swapped in as a whole
+type vertRuntime struct {
+	upstream env.UpstreamMap
+	slots    map[string]*serverSlot
+	certs    *certStore
+
+	drainTimeout time.Duration // for servers stopped when the runtime is applied
+}
+
+func buildRuntime(conf *Conf) (*vertRuntime, error) {
+	upstream, err := env.BuildUpstream(conf.Upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	slots, certs, err := buildServerSlots(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &vertRuntime{upstream: upstream, slots: slots, certs: certs, drainTimeout: conf.Base.DrainTimeout}, nil
+}
+
+func reload() error {
+	conf, err := loadConf(gConfFile)
+	if err != nil {
+		return err
+	}
+
+	//the admin API serving the reload cannot be rebound by it
+	if conf.Base.AdminListen != curConf().Base.AdminListen {
+		return errors.New("admin_listen cannot be changed by reload, restart to apply it")
+	}
+
+	rt, err := buildRuntime(conf)
+	if err != nil {
+		return err
+	}
+
+	if err := applyRuntime(rt); err != nil {
+		return err
+	}
+
+	env.SetStickySecret(conf.Base.StickySecret)
+	action.SetTrustedProxies(conf.Base.iTrustedProxies)
+	action.SetCompression(conf.Base.iCompression)
+	setConf(conf)
+	return nil
+}
+
 func main() {
-	if err := loadConf(); err != nil {
+	parseFlags()
+
+	if gCheckOnly {
+		os.Exit(runCheck())
+	}
+
+	conf, err := loadConf(gConfFile)
+	if err != nil {
 		fmt.Println("load config failed: ", err)
 		return
 	}
+	setConf(conf)
 
 	//init base systems
 	initLog()
+	defer joinLog()
 	initCertManager()
 	action.SetLogger(Logger{})
+	env.SetLogger(Logger{})
+	env.SetStickySecret(conf.Base.StickySecret)
+	action.SetTrustedProxies(conf.Base.iTrustedProxies)
+	action.SetCompression(conf.Base.iCompression)
 
 	//build server slots
-	slots, err := buildServerSlots(gConf.Sites)
+	rt, err := buildRuntime(conf)
 	if err != nil {
 		fmt.Println("build server slots failed: ", err)
 		return
 	}
 
-	//set port 80 default slot if not exist
-	if _, ok := slots[80]; !ok {
-		slots[80] = &serverSlot{
-			port:   80,
-			isTls:  false,
-			router: mux.NewRouter(),
-		}
-	}
-	if slots[80].isTls {
-		fmt.Println("Port 80 cannot run HTTPS!")
-		return
-	}
-
-	tls_config := gCertManager.TLSConfig()
-	tls_config.GetCertificate = getCert
+	gTlsConfig = gCertManager.TLSConfig()
+	initSystemdListeners()
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
 	//start all server slots
-	for port, slot := range slots {
-		server := &http.Server{
-			Addr:        fmt.Sprintf(":%d", port),
-			TLSConfig:   tls_config,
-			Handler:     slot.router,
-			IdleTimeout: time.Second * 300,
-		}
+	if err := applyRuntime(rt); err != nil {
+		fmt.Println("start servers failed: ", err)
+		return
+	}
 
-		if port == 80 {
-			server.Handler = gCertManager.HTTPHandler(server.Handler)
-		}
-		server.Handler = logHandler(server.Handler)
+	ch_reload := make(chan chan error)
+	ch_done := make(chan bool)
 
-		if slot.isTls {
-			INFO_LOG("Start HTTPS on port %d ...", port)
-			go server.ListenAndServeTLS("", "")
-		} else {
-			INFO_LOG("Start HTTP on port %d ...", port)
-			go server.ListenAndServe()
-		}
+	if err := startAdmin(conf.Base.AdminListen, ch_reload); err != nil {
+		fmt.Println("start admin API failed: ", err)
+		shutdownServers()
+		return
 	}
+	defer stopAdmin()
 
-	ch_done := make(chan bool)
-	go waitSignal(ch_done)
-	<-ch_done
+	go waitSignal(ch_reload, ch_done)
+
+	for {
+		select {
+		case ch_ret := <-ch_reload:
+			ch_ret <- reload()
+		case <-ch_done:
+			shutdownServers()
+			return
+		}
+	}
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zerozwt/Vert/action"
+	"github.com/zerozwt/Vert/env"
+)
+
+const proxyHeaderTimeout time.Duration = time.Second * 10
+const proxyV1MaxLength int = 107
+
+// proxyListener accepts connections starting with PROXY protocol v1 or v2 headers, only
+// connections from trusted_proxies are accepted
+type proxyListener struct {
+	net.Listener
+}
+
+// proxyConn parses the header on first Read or RemoteAddr, which runs in the goroutine
+// serving the connection instead of the accepting one
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (self *proxyListener) Accept() (net.Conn, error) {
+	conn, err := self.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func (self *proxyConn) init() {
+	self.once.Do(func() {
+		self.remote = self.Conn.RemoteAddr()
+
+		peer := ""
+		if addr, ok := self.remote.(*net.TCPAddr); ok {
+			peer = addr.IP.String()
+		}
+		if !action.IsTrustedProxy(peer) {
+			self.err = errors.New("PROXY protocol header from untrusted peer " + self.remote.String())
+		} else {
+			self.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+			var remote net.Addr
+			if remote, self.err = readProxyHeader(self.reader); remote != nil {
+				self.remote = remote
+			}
+			self.Conn.SetReadDeadline(time.Time{})
+		}
+
+		if self.err != nil {
+			ERROR_LOG("%v", self.err)
+			self.Conn.Close()
+		}
+	})
+}
+
+func (self *proxyConn) Read(buf []byte) (int, error) {
+	self.init()
+	if self.err != nil {
+		return 0, self.err
+	}
+	return self.reader.Read(buf)
+}
+
+func (self *proxyConn) RemoteAddr() net.Addr {
+	self.init()
+	return self.remote
+}
+
+// readProxyHeader reads a v1 or v2 header, the returned address is nil if the header
+// carries no client address, e.g. health checks of the load balancer
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	sig, err := reader.Peek(len(env.ProxyV2Signature))
+	if err != nil {
+		return nil, errors.New("read PROXY protocol header failed: " + err.Error())
+	}
+	if bytes.Equal(sig, env.ProxyV2Signature) {
+		return readProxyV2(reader)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyV1(reader)
+	}
+	return nil, errors.New("PROXY protocol header not found")
+}
+
+// readProxyV1 reads "PROXY TCP4|TCP6|UNKNOWN SRC DST SRC_PORT DST_PORT\r\n"
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, errors.New("PROXY protocol v1 header too long")
+		}
+		ch, err := reader.ReadByte()
+		if err != nil {
+			return nil, errors.New("read PROXY protocol header failed: " + err.Error())
+		}
+		line = append(line, ch)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("malformed PROXY protocol v1 header: " + string(line[:len(line)-2]))
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("malformed PROXY protocol v1 header: " + string(line[:len(line)-2]))
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	head := make([]byte, len(env.ProxyV2Signature)+4)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		return nil, errors.New("read PROXY protocol header failed: " + err.Error())
+	}
+	head = head[len(env.ProxyV2Signature):]
+	if head[0]>>4 != 2 {
+		return nil, errors.New("unsupported PROXY protocol version " + strconv.Itoa(int(head[0]>>4)))
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(head[2:]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, errors.New("read PROXY protocol header failed: " + err.Error())
+	}
+
+	//LOCAL command, or addresses other than TCP over IPv4/IPv6
+	if head[0]&0x0F != 1 {
+		return nil, nil
+	}
+	switch head[1] {
+	case 0x11:
+		if len(body) >= 12 {
+			return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+		}
+	case 0x21:
+		if len(body) >= 36 {
+			return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+		}
+	default:
+		return nil, nil
+	}
+	return nil, errors.New("malformed PROXY protocol v2 header")
+}
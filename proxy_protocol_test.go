@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/zerozwt/Vert/action"
+)
+
+func TestProxyProtocol(t *testing.T) {
+	proxies, _ := action.ParseTrustedProxies([]string{"127.0.0.1"})
+	action.SetTrustedProxies(proxies)
+	defer action.SetTrustedProxies(nil)
+
+	ln, err := listen(&serverSlot{listen: "127.0.0.1:0", proxyProtocol: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ln.Close()
+
+	v2 := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0x11, 0, 12, 1, 2, 3, 4, 127, 0, 0, 1, 0x1F, 0x90, 0, 80)
+	v2_local := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x20, 0x00, 0, 0)
+	cases := []struct {
+		header string
+		remote string // empty if the connection address is kept
+		ok     bool
+	}{
+		{"PROXY TCP4 1.2.3.4 127.0.0.1 8080 80\r\n", "1.2.3.4:8080", true},
+		{"PROXY TCP6 2001:db8::1 ::1 8080 80\r\n", "[2001:db8::1]:8080", true},
+		{"PROXY UNKNOWN\r\n", "", true},
+		{string(v2), "1.2.3.4:8080", true},
+		{string(v2_local), "", true},
+		{"PROXY TCP4 1.2.3.4\r\n", "", false},
+		{"GET / HTTP/1.1\r\n", "", false},
+	}
+
+	for _, item := range cases {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		client.Write([]byte(item.header + "payload"))
+		client.(*net.TCPConn).CloseWrite()
+
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		remote := conn.RemoteAddr().String()
+		data, err := ioutil.ReadAll(conn)
+		conn.Close()
+		client.Close()
+
+		if !item.ok {
+			if err == nil {
+				t.Errorf("malformed header should fail: %q", item.header)
+			}
+			continue
+		}
+		if err != nil || string(data) != "payload" {
+			t.Errorf("data after header %q not as expected: %q %v", item.header, data, err)
+		}
+		if len(item.remote) > 0 && remote != item.remote {
+			t.Errorf("remote address of header %q not as expected: %s", item.header, remote)
+		} else if len(item.remote) == 0 && !strings.HasPrefix(remote, "127.0.0.1:") {
+			t.Errorf("remote address of header %q should be kept: %s", item.header, remote)
+		}
+	}
+
+	//connections from untrusted peers are rejected
+	action.SetTrustedProxies(nil)
+	client, _ := net.Dial("tcp", ln.Addr().String())
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 1.2.3.4 127.0.0.1 8080 80\r\n"))
+	conn, _ := ln.Accept()
+	if _, err := bufio.NewReader(conn).ReadByte(); err == nil {
+		t.Errorf("header from untrusted peer should be rejected")
+	}
+}
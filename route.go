@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/zerozwt/Vert/action"
+)
+
+const route_prefix int = 1
+const route_exact int = 2
+const route_regexp int = 3
+
+// routeSpec is a compiled rule key, which is a path optionally followed by matchers:
+//
+//	/api/                      path prefix
+//	= /healthz                 exact path
+//	~ ^/v(?P<ver>[0-9]+)/      regular expression on path, named groups are exposed as {mux:NAME}
+//	method=GET,HEAD            HTTP methods
+//	header:X-Canary=1          header value, header:X-Canary only checks existence
+//	query:debug=1              query value, query:debug only checks existence
+//	client=10.0.0.0/8,::1/128  client address in CIDR
+type routeSpec struct {
+	key  string
+	kind int
+	path string
+
+	pattern *regexp.Regexp
+	methods []string
+	headers []string // key value pairs
+	queries []string // key value pairs
+	clients []*net.IPNet
+
+	handler http.Handler
+	actions []string
+}
+
+func parseRouteKey(key string) (*routeSpec, error) {
+	ret := &routeSpec{key: key}
+	fields := action.SplitFields(key)
+	if len(fields) == 0 {
+		return nil, errors.New("empty rule")
+	}
+
+	for idx := 0; idx < len(fields); idx++ {
+		field := fields[idx]
+
+		if field == "=" || field == "~" {
+			if idx+1 >= len(fields) {
+				return nil, errors.New("missing path after '" + field + "'")
+			}
+			idx++
+			field += fields[idx]
+		}
+
+		var err error
+		switch {
+		case strings.HasPrefix(field, "="):
+			err = ret.setPath(route_exact, field[1:])
+		case strings.HasPrefix(field, "~"):
+			err = ret.setPath(route_regexp, field[1:])
+		case strings.HasPrefix(field, "/"):
+			err = ret.setPath(route_prefix, field)
+		case strings.HasPrefix(field, "method="):
+			for _, method := range strings.Split(field[len("method="):], ",") {
+				if len(method) > 0 {
+					ret.methods = append(ret.methods, strings.ToUpper(method))
+				}
+			}
+			if len(ret.methods) == 0 {
+				err = errors.New("no method in " + field)
+			}
+		case strings.HasPrefix(field, "header:"):
+			ret.headers, err = appendPair(ret.headers, field[len("header:"):])
+		case strings.HasPrefix(field, "query:"):
+			ret.queries, err = appendPair(ret.queries, field[len("query:"):])
+		case strings.HasPrefix(field, "client="):
+			for _, item := range strings.Split(field[len("client="):], ",") {
+				_, cidr, err := net.ParseCIDR(item)
+				if err != nil {
+					return nil, err
+				}
+				ret.clients = append(ret.clients, cidr)
+			}
+		default:
+			err = errors.New("unknown matcher " + field)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+func (self *routeSpec) setPath(kind int, path string) error {
+	if self.kind != 0 {
+		return errors.New("more than one path in rule")
+	}
+	if len(path) == 0 {
+		return errors.New("empty path in rule")
+	}
+
+	if kind == route_regexp {
+		pattern, err := regexp.Compile(path)
+		if err != nil {
+			return err
+		}
+		self.pattern = pattern
+	}
+
+	self.kind = kind
+	self.path = path
+	return nil
+}
+
+func appendPair(pairs []string, field string) ([]string, error) {
+	key, value := field, ""
+	if idx := strings.Index(field, "="); idx >= 0 {
+		key, value = field[:idx], field[idx+1:]
+	}
+	if len(key) == 0 {
+		return nil, errors.New("empty key in matcher")
+	}
+	return append(pairs, key, value), nil
+}
+
+func (self *routeSpec) register(router *mux.Router) error {
+	route := router.NewRoute()
+	handler := self.handler
+
+	switch self.kind {
+	case route_exact:
+		route.Path(self.path)
+	case route_prefix:
+		route.PathPrefix(self.path)
+	case route_regexp:
+		route.MatcherFunc(func(req *http.Request, match *mux.RouteMatch) bool {
+			return self.pattern.MatchString(req.URL.Path)
+		})
+		handler = regexpVars(self.pattern, handler)
+	}
+
+	if len(self.methods) > 0 {
+		route.Methods(self.methods...)
+	}
+	if len(self.headers) > 0 {
+		route.Headers(self.headers...)
+	}
+	if len(self.queries) > 0 {
+		route.Queries(self.queries...)
+	}
+	if len(self.clients) > 0 {
+		route.MatcherFunc(func(req *http.Request, match *mux.RouteMatch) bool {
+			ip := clientIP(req)
+			for _, cidr := range self.clients {
+				if ip != nil && cidr.Contains(ip) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+
+	route.Handler(handler)
+	return route.GetError()
+}
+
+// regexpVars exposes named groups of a path regexp as mux variables
+func regexpVars(pattern *regexp.Regexp, underlying http.Handler) http.Handler {
+	names := pattern.SubexpNames()
+	return http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		match := pattern.FindStringSubmatch(req.URL.Path)
+		vars := make(map[string]string)
+		for key, value := range mux.Vars(req) {
+			vars[key] = value
+		}
+		for idx, name := range names {
+			if len(name) > 0 && idx < len(match) {
+				vars[name] = match[idx]
+			}
+		}
+		underlying.ServeHTTP(rsp, mux.SetURLVars(req, vars))
+	})
+}
+
+func clientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// sortRoutes orders routes for "longest prefix wins" mode: exact and regexp routes come first
+// in file order, then prefix routes from the longest to the shortest
+func sortRoutes(routes []*routeSpec) []*routeSpec {
+	ret := append([]*routeSpec{}, routes...)
+	rank := func(item *routeSpec) int {
+		if item.kind == route_exact || item.kind == route_regexp {
+			return -1
+		}
+		return len(item.path)
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		ri, rj := rank(ret[i]), rank(ret[j])
+		if ri < 0 || rj < 0 {
+			return ri < 0 && rj >= 0
+		}
+		return ri > rj
+	})
+	return ret
+}
+
+// defaultSiteName is the site serving requests whose host matches no other site of the port
+const defaultSiteName string = "_default"
+
+func isWildcardHost(name string) bool { return strings.ContainsAny(name, "*{") }
+
+// hostTemplate converts a site name to mux host template, each '*' label matches exactly one label
+func hostTemplate(name string) string {
+	labels := strings.Split(name, ".")
+	wildcard := 0
+	for idx, label := range labels {
+		if label == "*" {
+			labels[idx] = fmt.Sprintf("{wildcard_%d}", wildcard)
+			wildcard++
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// orderedSiteNames returns site names in the order their hosts should be matched: exact names,
+// then wildcard names from the most specific one, then _default
+func orderedSiteNames(sites map[string][]SiteConf) []string {
+	ret := sortedSiteNames(sites)
+
+	class := func(name string) int {
+		if name == defaultSiteName {
+			return 2
+		}
+		if isWildcardHost(name) {
+			return 1
+		}
+		return 0
+	}
+	wildcards := func(name string) int {
+		ret := 0
+		for _, label := range strings.Split(name, ".") {
+			if strings.ContainsAny(label, "*{") {
+				ret++
+			}
+		}
+		return ret
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		ci, cj := class(ret[i]), class(ret[j])
+		if ci != cj || ci != 1 {
+			return ci < cj
+		}
+		li, lj := strings.Count(ret[i], "."), strings.Count(ret[j], ".")
+		if li != lj {
+			return li > lj
+		}
+		return wildcards(ret[i]) < wildcards(ret[j])
+	})
+	return ret
+}
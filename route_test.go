@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func testRouter(keys []string, longest_prefix bool, t *testing.T) *mux.Router {
+	routes := make([]*routeSpec, 0)
+	for idx, key := range keys {
+		route, err := parseRouteKey(key)
+		if err != nil {
+			t.Errorf("parse rule '%s' failed: %v", key, err)
+			return nil
+		}
+		tag := fmt.Sprint(idx)
+		route.handler = http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+			rsp.Write([]byte(tag + mux.Vars(req)["ver"]))
+		})
+		routes = append(routes, route)
+	}
+
+	if longest_prefix {
+		routes = sortRoutes(routes)
+	}
+
+	router := mux.NewRouter()
+	for _, route := range routes {
+		if err := route.register(router); err != nil {
+			t.Errorf("register rule '%s' failed: %v", route.key, err)
+			return nil
+		}
+	}
+	return router
+}
+
+func testRoute(router *mux.Router, req *http.Request) string {
+	rsp := httptest.NewRecorder()
+	router.ServeHTTP(rsp, req)
+	if rsp.Code != 200 {
+		return fmt.Sprint(rsp.Code)
+	}
+	return rsp.Body.String()
+}
+
+func TestRouteMatchers(t *testing.T) {
+	router := testRouter([]string{
+		"= /healthz",
+		`~ '^/v(?P<ver>[0-9]+)/'`,
+		"/api/ method=POST,put",
+		"/api/ header:X-Canary=1",
+		"/api/ query:debug",
+		"/api/ client=10.0.0.0/8",
+		"/",
+	}, false, t)
+	if router == nil {
+		return
+	}
+
+	newReq := func(method, uri string) *http.Request {
+		req := httptest.NewRequest(method, uri, nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		return req
+	}
+
+	canary := newReq("GET", "/api/x")
+	canary.Header.Set("X-Canary", "1")
+	internal := newReq("GET", "/api/x")
+	internal.RemoteAddr = "10.1.2.3:12345"
+
+	cases := []struct {
+		req    *http.Request
+		expect string
+	}{
+		{newReq("GET", "/healthz"), "0"},
+		{newReq("GET", "/healthz/x"), "6"},
+		{newReq("GET", "/v12/x"), "112"},
+		{newReq("PUT", "/api/x"), "2"},
+		{canary, "3"},
+		{newReq("GET", "/api/x?debug="), "4"},
+		{internal, "5"},
+		{newReq("GET", "/api/x"), "6"},
+	}
+
+	for _, item := range cases {
+		if tmp := testRoute(router, item.req); tmp != item.expect {
+			t.Errorf("%s %s routed to %s, expected %s", item.req.Method, item.req.URL, tmp, item.expect)
+		}
+	}
+}
+
+func TestRouteLongestPrefix(t *testing.T) {
+	keys := []string{"/", "/api/", "/api/v2/", "= /api/", "/static/"}
+
+	router := testRouter(keys, false, t)
+	if router == nil {
+		return
+	}
+	if tmp := testRoute(router, httptest.NewRequest("GET", "/api/v2/x", nil)); tmp != "0" {
+		t.Errorf("file order: /api/v2/x routed to %s, expected 0", tmp)
+	}
+
+	router = testRouter(keys, true, t)
+	if router == nil {
+		return
+	}
+	expect := map[string]string{
+		"/api/v2/x": "2",
+		"/api/":     "3",
+		"/api/x":    "1",
+		"/x":        "0",
+	}
+	for uri, tag := range expect {
+		if tmp := testRoute(router, httptest.NewRequest("GET", uri, nil)); tmp != tag {
+			t.Errorf("longest prefix: %s routed to %s, expected %s", uri, tmp, tag)
+		}
+	}
+}
+
+func TestRouteKeyError(t *testing.T) {
+	for _, key := range []string{"", "=", "/a/ /b/", "~ (", "foo", "/ client=1.2.3.4", "/ method="} {
+		if _, err := parseRouteKey(key); err == nil {
+			t.Errorf("malformed rule '%s' parsed without error", key)
+		}
+	}
+}
+
+func TestSiteHost(t *testing.T) {
+	sites := map[string][]SiteConf{}
+	for idx, name := range []string{"_default", "*.example.com", "{tenant}.app.example.com", "www.example.com"} {
+		sites[name] = []SiteConf{{
+			Type:   "http",
+			Port:   8080,
+			Listen: ":8080",
+			Rules:  RuleList{{Key: "/", Actions: []string{fmt.Sprintf("redirect http://site%d/{mux:tenant}", idx)}}},
+		}}
+	}
+	sites["www.example.com"][0].Rules[0].Key = "/www/"
+
+	slots, _, err := buildServerSlots(&Conf{Sites: sites})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	router := slots[":8080"].router
+
+	expect := map[string]string{
+		"http://www.example.com/www/":      "http://site3/",
+		"http://www.example.com:8080/www/": "http://site3/",
+		"http://www.example.com/other":     "404",
+		"http://foo.example.com/":          "http://site1/",
+		"http://acme.app.example.com/":     "http://site2/acme",
+		"http://a.b.app.example.com/":      "http://site0/",
+		"http://127.0.0.1/":                "http://site0/",
+		"http://example.com/":              "http://site0/",
+	}
+	for uri, location := range expect {
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, httptest.NewRequest("GET", uri, nil))
+		tmp := rsp.Header().Get("Location")
+		if rsp.Code == 404 {
+			tmp = "404"
+		}
+		if tmp != location {
+			t.Errorf("%s routed to %s, expected %s", uri, tmp, location)
+		}
+	}
+}
+
+func TestCertLookup(t *testing.T) {
+	store := newCertStore()
+	for idx, name := range []string{"www.example.com", "*.example.com", "api.*.example.com", "{tenant}.app.example.com"} {
+		if err := store.Add(name, ":443", certInfo{SSLCert: fmt.Sprint(idx)}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	store.Add(defaultSiteName, ":443", certInfo{SSLCert: "default"})
+
+	if err := store.Add("*.example.org", ":443", certInfo{AutoCert: true}); err == nil {
+		t.Errorf("autocert accepted for wildcard site")
+	}
+
+	expect := map[string]string{
+		"www.example.com":      "0",
+		"foo.example.com":      "1",
+		"api.foo.example.com":  "2",
+		"acme.app.example.com": "3",
+		"a.b.c.example.com":    "default",
+		"":                     "default",
+	}
+	for name, cert := range expect {
+		if info, ok := store.Lookup(name, ":443"); !ok || info.SSLCert != cert {
+			t.Errorf("cert for '%s' is %s, expected %s", name, info.SSLCert, cert)
+		}
+	}
+
+	if _, ok := store.Lookup("a.b.c.example.com", ":8443"); ok {
+		t.Errorf("default cert of port 443 returned for port 8443")
+	}
+}
+
+func TestSiteMultiListen(t *testing.T) {
+	site := func(listen string, cert string) SiteConf {
+		return SiteConf{Type: "https", Port: 8443, Listen: listen, SSLCert: cert, SSLKey: cert + ".key"}
+	}
+	sites := map[string][]SiteConf{
+		"example.com":   {site("127.0.0.1:8443", "/path/to/cert"), site("[::1]:8443", "/path/to/cert")},
+		"*.example.com": {site("127.0.0.1:8443", "/path/to/wildcard"), site("[::1]:8443", "/path/to/wildcard")},
+	}
+
+	slots, certs, err := buildServerSlots(&Conf{Sites: sites})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, listen := range []string{"127.0.0.1:8443", "[::1]:8443"} {
+		if _, ok := slots[listen]; !ok {
+			t.Errorf("slot of %s not created", listen)
+		}
+		if info, ok := certs.Lookup("example.com", listen); !ok || info.SSLCert != "/path/to/cert" {
+			t.Errorf("cert of example.com on %s not as expected: %v", listen, info)
+		}
+		if info, ok := certs.Lookup("www.example.com", listen); !ok || info.SSLCert != "/path/to/wildcard" {
+			t.Errorf("cert of www.example.com on %s not as expected: %v", listen, info)
+		}
+	}
+
+	//one host name cannot be served twice on one address
+	dup := map[string][]SiteConf{"example.com": {site("127.0.0.1:8443", "/path/to/cert"), site("127.0.0.1:8443", "/path/to/cert")}}
+	if _, _, err := buildServerSlots(&Conf{Sites: dup}); err == nil || !strings.Contains(err.Error(), "duplicate site") {
+		t.Errorf("duplicate site should be rejected: %v", err)
+	}
+
+	//one host name cannot have different certs
+	sites["example.com"][1].SSLCert = "/path/to/other"
+	if _, _, err := buildServerSlots(&Conf{Sites: sites}); err == nil {
+		t.Errorf("different certs of example.com should be rejected")
+	}
+}
+
+func TestSlotProxyProtocol(t *testing.T) {
+	sites := map[string][]SiteConf{
+		"a.example.com": {{Type: "http", Port: 8080, Listen: ":8080", ProxyProtocol: true}},
+		"b.example.com": {{Type: "http", Port: 8080, Listen: ":8080", ProxyProtocol: true}},
+	}
+	slots, _, err := buildServerSlots(&Conf{Sites: sites})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !slots[":8080"].proxyProtocol {
+		t.Errorf("PROXY protocol of :8080 not enabled")
+	}
+
+	//sites on one listen address must agree
+	sites["b.example.com"][0].ProxyProtocol = false
+	if _, _, err := buildServerSlots(&Conf{Sites: sites}); err == nil || !strings.Contains(err.Error(), "proxy_protocol") {
+		t.Errorf("conflicting proxy_protocol should be rejected: %v", err)
+	}
+}
+
+func TestAcmeSlot(t *testing.T) {
+	sites := map[string][]SiteConf{
+		"www.example.com": {{Type: "https", Port: 443, Listen: "10.0.0.1:443", AutoCert: true}},
+	}
+
+	conf := &Conf{Sites: sites}
+	conf.Base.AcmeHttp = ":80"
+	slots, _, err := buildServerSlots(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if slot, ok := slots[":80"]; !ok || !slot.acme || slot.isTls {
+		t.Errorf("ACME HTTP-01 slot not created for autocert site")
+	}
+
+	sites["www.example.com"][0].AutoCert = false
+	sites["www.example.com"][0].SSLCert = "/path/to/cert"
+	slots, _, err = buildServerSlots(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, ok := slots[":80"]; ok {
+		t.Errorf("ACME HTTP-01 slot created without autocert site")
+	}
+
+	sites["www.example.com"][0].AutoCert = true
+	sites["other.example.com"] = []SiteConf{{Type: "http", Port: 80, Listen: "10.0.0.1:80"}}
+	slots, _, err = buildServerSlots(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, ok := slots[":80"]; ok || !slots["10.0.0.1:80"].acme {
+		t.Errorf("existing slot on port 80 not used for ACME HTTP-01")
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zerozwt/Vert/action"
+	"github.com/zerozwt/Vert/env"
+)
+
+// slotServer is a running listener, its handler can be swapped on config reload
+// without touching established connections
+type slotServer struct {
+	listen string
+	isTls  bool
+	mode   os.FileMode
+	limits ServerLimits
+
+	proxyProtocol bool
+
+	listener net.Listener
+	server   *http.Server
+	handler  atomic.Value // http.Handler
+}
+
+var gTlsConfig *tls.Config
+var gServers map[string]*slotServer = make(map[string]*slotServer) // key: listen address
+var gRuntime atomic.Value                                          // *vertRuntime, the running one
+
+func (self *slotServer) ServeHTTP(rsp http.ResponseWriter, req *http.Request) {
+	self.handler.Load().(http.Handler).ServeHTTP(rsp, req)
+}
+
+func startServer(slot *serverSlot, ln net.Listener) *slotServer {
+	ret := &slotServer{
+		listen:   slot.listen,
+		isTls:    slot.isTls,
+		mode:     slot.mode,
+		limits:   slot.limits,
+		listener: ln,
+
+		proxyProtocol: slot.proxyProtocol,
+	}
+	ret.handler.Store(slot.handler())
+
+	tls_config := gTlsConfig.Clone()
+	tls_config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return getCert(hello, ret.listen)
+	}
+
+	ret.server = &http.Server{
+		TLSConfig:         tls_config,
+		Handler:           ret,
+		ReadHeaderTimeout: slot.limits.ReadHeaderTimeout,
+		ReadTimeout:       slot.limits.ReadTimeout,
+		WriteTimeout:      slot.limits.WriteTimeout,
+		IdleTimeout:       slot.limits.IdleTimeout,
+		MaxHeaderBytes:    int(slot.limits.iMaxHeaderBytes),
+	}
+	if ret.server.ReadHeaderTimeout == 0 {
+		ret.server.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+	if ret.server.IdleTimeout == 0 {
+		ret.server.IdleTimeout = defaultIdleTimeout
+	}
+
+	if ret.isTls {
+		INFO_LOG("Start HTTPS on %s ...", ret.listen)
+		go ret.server.ServeTLS(ln, "", "")
+	} else {
+		INFO_LOG("Start HTTP on %s ...", ret.listen)
+		go ret.server.Serve(ln)
+	}
+
+	return ret
+}
+
+// stop closes the listener at once and lets in-flight requests finish in background
+func (self *slotServer) stop(timeout time.Duration) {
+	INFO_LOG("Stop server on %s ...", self.listen)
+	self.listener.Close()
+	go self.shutdown(timeout)
+}
+
+// shutdown waits for in-flight requests to finish, connections still active
+// after timeout are closed forcibly
+func (self *slotServer) shutdown(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := self.server.Shutdown(ctx); err != nil {
+		ERROR_LOG("drain server on %s failed: %v", self.listen, err)
+		self.server.Close()
+		return
+	}
+	INFO_LOG("Server on %s stopped", self.listen)
+}
+
+// shutdownServers stops every running server and proxied websocket, and returns
+// when all of them are drained or drain timeout exceeds
+func shutdownServers() {
+	timeout := curConf().Base.DrainTimeout
+	INFO_LOG("Draining all servers, timeout=%v ...", timeout)
+
+	wg := sync.WaitGroup{}
+	for _, running := range gServers {
+		wg.Add(1)
+		go func(item *slotServer) {
+			defer wg.Done()
+			item.shutdown(timeout)
+		}(running)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := action.ShutdownWebsocket(ctx); err != nil {
+			ERROR_LOG("drain websocket failed: %v", err)
+		}
+	}()
+
+	wg.Wait()
+	gServers = make(map[string]*slotServer)
+}
+
+// slot rebuilds the slot the server was started with, except for the handler
+func (self *slotServer) slot() *serverSlot {
+	return &serverSlot{
+		listen:        self.listen,
+		mode:          self.mode,
+		isTls:         self.isTls,
+		limits:        self.limits,
+		proxyProtocol: self.proxyProtocol,
+	}
+}
+
+// reopen listens on the address again after the listener is closed for a failed rebind
+func (self *slotServer) reopen() {
+	ln, err := listen(self.slot())
+	if err != nil {
+		ERROR_LOG("reopen %s failed: %v", self.listen, err)
+		return
+	}
+	self.listener = ln
+	if self.isTls {
+		go self.server.ServeTLS(ln, "", "")
+	} else {
+		go self.server.Serve(ln)
+	}
+}
+
+// compatible tells whether the running server can serve slot by swapping its handler
+func (self *slotServer) compatible(slot *serverSlot) bool {
+	return slot.isTls == self.isTls && slot.limits == self.limits && slot.proxyProtocol == self.proxyProtocol
+}
+
+// applyRuntime makes rt the running config: listeners are opened for new addresses, closed for
+// removed addresses, and existing ones get their handlers swapped. If any address fails to bind,
+// the running config is kept and the error is returned.
+func applyRuntime(rt *vertRuntime) error {
+	//bind new addresses first, so that a failure leaves the running config untouched
+	fresh := make(map[string]net.Listener)
+	rollback := func() {
+		for _, item := range fresh {
+			item.Close()
+		}
+	}
+	for addr, slot := range rt.slots {
+		if _, ok := gServers[addr]; ok {
+			continue
+		}
+
+		ln, err := listen(slot)
+		if err != nil {
+			rollback()
+			return err
+		}
+		fresh[addr] = ln
+	}
+
+	//site type, server limits or PROXY protocol of these addresses changed, they can be rebound
+	//only after old listeners are closed. Old listeners are reopened if any of them fails.
+	rebound := make([]*slotServer, 0)
+	for addr, running := range gServers {
+		slot, ok := rt.slots[addr]
+		if !ok || running.compatible(slot) {
+			continue
+		}
+
+		running.listener.Close()
+		ln, err := listen(slot)
+		if err != nil {
+			rollback()
+			for _, item := range append(rebound, running) {
+				item.reopen()
+			}
+			return errors.New("rebind " + addr + " failed: " + err.Error())
+		}
+		fresh[addr] = ln
+		rebound = append(rebound, running)
+	}
+
+	env.SetUpstream(rt.upstream)
+	setCertInfo(rt.certs)
+
+	for addr, running := range gServers {
+		slot, ok := rt.slots[addr]
+		if ok && running.compatible(slot) {
+			running.handler.Store(slot.handler())
+			if slot.mode != running.mode {
+				running.mode = slot.mode
+				if err := chmodSocket(slot); err != nil {
+					ERROR_LOG("chmod socket %s failed: %v", addr, err)
+				}
+			}
+			continue
+		}
+
+		running.stop(rt.drainTimeout)
+		delete(gServers, addr)
+	}
+
+	for addr, ln := range fresh {
+		gServers[addr] = startServer(rt.slots[addr], ln)
+	}
+
+	gRuntime.Store(rt)
+	return nil
+}
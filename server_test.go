@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestApplyRuntime(t *testing.T) {
+	gTlsConfig = &tls.Config{}
+	defer applyRuntime(&vertRuntime{certs: newCertStore()})
+
+	free := func() string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		return ln.Addr().String()
+	}
+	addr_a, addr_b := free(), free()
+
+	runtime := func(bodies map[string]string) *vertRuntime {
+		ret := &vertRuntime{slots: make(map[string]*serverSlot), certs: newCertStore()}
+		for addr, body := range bodies {
+			router := mux.NewRouter()
+			data := []byte(body)
+			router.PathPrefix("/").HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) { rsp.Write(data) })
+			ret.slots[addr] = &serverSlot{listen: addr, router: router}
+		}
+		return ret
+	}
+	client := &http.Client{Timeout: time.Second, Transport: &http.Transport{DisableKeepAlives: true}}
+	get := func(addr string) string {
+		rsp, err := client.Get("http://" + addr + "/")
+		if err != nil {
+			return ""
+		}
+		defer rsp.Body.Close()
+		data, _ := ioutil.ReadAll(rsp.Body)
+		return string(data)
+	}
+
+	if err := applyRuntime(runtime(map[string]string{addr_a: "a1"})); err != nil {
+		t.Error(err)
+		return
+	}
+	if body := get(addr_a); body != "a1" {
+		t.Errorf("response of %s not as expected: %q", addr_a, body)
+	}
+
+	//A gets its handler swapped, B is added
+	if err := applyRuntime(runtime(map[string]string{addr_a: "a2", addr_b: "b2"})); err != nil {
+		t.Error(err)
+		return
+	}
+	if body_a, body_b := get(addr_a), get(addr_b); body_a != "a2" || body_b != "b2" {
+		t.Errorf("responses after adding %s not as expected: %q %q", addr_b, body_a, body_b)
+	}
+
+	//A is removed
+	if err := applyRuntime(runtime(map[string]string{addr_b: "b3"})); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, ok := gServers[addr_a]; ok {
+		t.Errorf("removed address %s still running", addr_a)
+	}
+	if body_a, body_b := get(addr_a), get(addr_b); body_a != "" || body_b != "b3" {
+		t.Errorf("responses after removing %s not as expected: %q %q", addr_a, body_a, body_b)
+	}
+
+	//an address failing to bind keeps the running config
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer occupied.Close()
+	addr_c := occupied.Addr().String()
+	if err := applyRuntime(runtime(map[string]string{addr_b: "b4", addr_c: "c4"})); err == nil {
+		t.Errorf("binding occupied address %s should fail", addr_c)
+	}
+	if body := get(addr_b); body != "b3" {
+		t.Errorf("running config should be kept after failure: %q", body)
+	}
+
+	//rebinding failure reopens the old listener
+	changed := runtime(map[string]string{addr_b: "b5"})
+	changed.slots[addr_b].proxyProtocol = true
+	changed.slots[addr_b].listen = "systemd:missing"
+	if err := applyRuntime(changed); err == nil {
+		t.Errorf("rebinding %s to a missing socket should fail", addr_b)
+	}
+	if body := get(addr_b); body != "b3" {
+		t.Errorf("old listener of %s should be reopened: %q", addr_b, body)
+	}
+}
+
+func TestApplyRuntimeDrain(t *testing.T) {
+	conf := &Conf{}
+	conf.Base.DrainTimeout = time.Hour
+	setConf(conf)
+	defer applyRuntime(&vertRuntime{certs: newCertStore()})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	started := make(chan bool, 1)
+	block := make(chan bool)
+	defer close(block)
+	router := mux.NewRouter()
+	router.PathPrefix("/").HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		started <- true
+		<-block
+	})
+	rt := &vertRuntime{slots: map[string]*serverSlot{addr: {listen: addr, router: router}}, certs: newCertStore()}
+	if err := applyRuntime(rt); err != nil {
+		t.Error(err)
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		rsp, err := http.Get("http://" + addr + "/")
+		if err == nil {
+			rsp.Body.Close()
+		}
+		done <- err
+	}()
+	<-started
+
+	//the removed server drains with the timeout of the new config, not the running one
+	if err := applyRuntime(&vertRuntime{certs: newCertStore(), drainTimeout: time.Millisecond * 50}); err != nil {
+		t.Error(err)
+		return
+	}
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("request in flight should be cut off after drain timeout")
+		}
+	case <-time.After(time.Second * 2):
+		t.Errorf("removed server not stopped after drain timeout")
+	}
+}